@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -18,9 +20,10 @@ import (
 )
 
 const (
-	defaultClientCA   = "ca.pem"
-	defaultClientCert = ""
-	defaultClientKey  = ""
+	defaultClientCA    = "ca.pem"
+	defaultClientCert  = ""
+	defaultClientKey   = ""
+	defaultClientToken = ""
 )
 
 type clientConfig struct {
@@ -30,6 +33,12 @@ type clientConfig struct {
 	ca   string
 	cert string
 	key  string
+
+	// File containing the bearer token presented to the servers
+	token string
+
+	// File containing the credentials the requests to S3 servers are signed with
+	s3Credentials string
 }
 
 func clientCmd() command {
@@ -41,6 +50,8 @@ func clientCmd() command {
 	fset.StringVar(&config.ca, "ca", defaultClientCA, "")
 	fset.StringVar(&config.cert, "cert", defaultClientCert, "")
 	fset.StringVar(&config.key, "key", defaultClientKey, "")
+	fset.StringVar(&config.token, "token", defaultClientToken, "")
+	fset.StringVar(&config.s3Credentials, "s3credentials", "", "")
 	run := func(args []string) error {
 		fset.Usage = func() { clientUsage(args[0], os.Stderr) }
 		fset.Parse(args[1:])
@@ -60,6 +71,8 @@ func clientRun(cmdName string, config clientConfig) error {
 	debug(1, "   ca='%s'\n", config.ca)
 	debug(1, "   cert='%s'\n", config.cert)
 	debug(1, "   key='%s'\n", config.key)
+	debug(1, "   token='%s'\n", config.token)
+	debug(1, "   s3credentials='%s'\n", config.s3Credentials)
 
 	// Process requests
 	return clientHandleRequests(config)
@@ -124,9 +137,103 @@ func clientVerifyLoadRequest(req *LoadRequest) error {
 	if req.Duration < 0 {
 		return fmt.Errorf("invalid duration %s", req.Duration)
 	}
+	if req.MaxAttempts < 0 {
+		return fmt.Errorf("invalid maximum number of attempts %d", req.MaxAttempts)
+	}
+	if req.Streams < 0 {
+		return fmt.Errorf("invalid number of streams %d", req.Streams)
+	}
+	if req.SampleInterval < 0 {
+		return fmt.Errorf("invalid sampling interval %s", req.SampleInterval)
+	}
+	for _, d := range []time.Duration{req.DialTimeout, req.TLSHandshakeTimeout, req.FirstByteTimeout, req.StallTimeout} {
+		if d < 0 {
+			return fmt.Errorf("invalid timeout %s", d)
+		}
+	}
+	if req.WorkerRate < 0 || req.ProcessRate < 0 {
+		return fmt.Errorf("invalid negative receive rate limit")
+	}
+	if req.ConnsPerServer < 0 {
+		return fmt.Errorf("invalid number of connections per server %d", req.ConnsPerServer)
+	}
+	if req.ConnsPerServer > 0 && req.TransportPerWorker {
+		return fmt.Errorf("the number of connections per server cannot be specified along with a transport per worker")
+	}
+	if len(req.Proxy) > 0 {
+		if _, err := fileserver.ParseProxyURL(req.Proxy); err != nil {
+			return err
+		}
+	}
+	if _, _, err := clientChecksumParams(req); err != nil {
+		return err
+	}
+	backend, err := clientBackend(req)
+	if err != nil {
+		return err
+	}
+	if backend.verify != nil {
+		if err := backend.verify(req); err != nil {
+			return err
+		}
+	}
+	if _, err := clientCopyMode(req); err != nil {
+		return err
+	}
+	if _, err := clientSinkDir(req); err != nil {
+		return err
+	}
 	return nil
 }
 
+// clientCopyMode returns the third-party copy mode specified in the load request
+func clientCopyMode(req *LoadRequest) (fileserver.CopyMode, error) {
+	switch strings.ToLower(req.TransferMode) {
+	case "download", "":
+		return fileserver.CopyNone, nil
+	case "tpc-pull":
+		return fileserver.CopyPull, nil
+	case "tpc-push":
+		return fileserver.CopyPush, nil
+	}
+	return fileserver.CopyNone, fmt.Errorf("invalid transfer mode %q", req.TransferMode)
+}
+
+// clientDigestFields returns the HTTP fields specified in the load request for
+// negotiating the checksum with the servers
+func clientDigestFields(req *LoadRequest) (fileserver.DigestFields, error) {
+	switch strings.ToLower(req.DigestFields) {
+	case "custom", "":
+		return fileserver.DigestCustom, nil
+	case "repr-digest":
+		return fileserver.DigestRepr, nil
+	case "digest":
+		return fileserver.DigestLegacy, nil
+	}
+	return fileserver.DigestCustom, fmt.Errorf("invalid digest fields %q", req.DigestFields)
+}
+
+// clientChecksumParams returns the checksum mode and algorithm specified in
+// the load request
+func clientChecksumParams(req *LoadRequest) (fileserver.ChecksumMode, fileserver.ChecksumAlgorithm, error) {
+	if len(req.ChecksumAlgorithm) == 0 {
+		return fileserver.ChecksumNone, fileserver.NONE, nil
+	}
+	algo, err := fileserver.ChecksumAlgorithmByName(req.ChecksumAlgorithm)
+	if err != nil {
+		return fileserver.ChecksumNone, fileserver.NONE, err
+	}
+	switch strings.ToLower(req.ChecksumMode) {
+	case "client":
+		return fileserver.ChecksumClientOnly, algo, nil
+	case "server":
+		return fileserver.ChecksumServerOnly, algo, nil
+	case "both", "":
+		return fileserver.ChecksumClientAndServer, algo, nil
+	}
+	return fileserver.ChecksumNone, fileserver.NONE, fmt.Errorf("invalid checksum mode %q", req.ChecksumMode)
+}
+
 func clientProcessLoadRequest(config clientConfig, req *LoadRequest) (*LoadResponse, error) {
 	// Create channels to send requests to the workers and receive
 	// responses from them. We start as many workers as specified
@@ -141,14 +248,41 @@ func clientProcessLoadRequest(config clientConfig, req *LoadRequest) (*LoadRespo
 	requests := make(chan *DownloadReq, numWorkers)
 	responses := make(chan *DownloadResp, numWorkers)
 
-	// Prepare the fileserver clients for serving this load request
-	fsclients := make([]*fileserver.Client, len(req.ServerAddrs))
-	for i := range req.ServerAddrs {
-		c, err := fileserver.NewClient(req.UseHttp1, config.cert, config.key, config.ca)
-		if err != nil {
-			return nil, fmt.Errorf("could not initialize fileserver client [%s]", err)
+	// Prepare the transferers for serving this load request. Each shard
+	// holds a transferer per server, and therefore a transport, and is
+	// shared by the workers assigned to it
+	numShards := 1
+	switch {
+	case req.TransportPerWorker:
+		numShards = numWorkers
+	case req.ConnsPerServer > 0:
+		numShards = minInt(req.ConnsPerServer, numWorkers)
+	}
+	entry, err := clientBackend(req)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := entry.factory(config, req)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize backend [%s]", err)
+	}
+	shards := make([][]Transferer, numShards)
+	for k := range shards {
+		shards[k] = make([]Transferer, len(req.ServerAddrs))
+		for i, server := range req.ServerAddrs {
+			t, err := backend.NewTransferer(server)
+			if err != nil {
+				return nil, fmt.Errorf("could not initialize transferer [%s]", err)
+			}
+			shards[k][i] = t
 		}
-		fsclients[i] = c
+	}
+
+	// Take a snapshot of the resource usage of the servers, for reporting
+	// their usage during the test
+	var statsBefore map[string]fileserver.ServerStats
+	if req.Churn {
+		statsBefore = clientServerStats(config, req)
 	}
 
 	// Start collecting responses from workers
@@ -160,35 +294,98 @@ func clientProcessLoadRequest(config clientConfig, req *LoadRequest) (*LoadRespo
 	var wg sync.WaitGroup
 	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
-		go clientWorker(i, &wg, requests)
+		var limiter *fileserver.RateLimiter
+		if req.WorkerRate > 0 {
+			limiter = fileserver.NewRateLimiter(req.WorkerRate)
+		}
+		go clientWorker(i, &wg, shards[i%numShards], limiter, requests)
 	}
 
 	// Start emitting requests
-	go clientEmitRequests(config, req, fsclients, requests, responses)
+	go clientEmitRequests(config, req, requests, responses)
 
 	// Wait for workers to finish their execution
 	wg.Wait()
 	debug(1, "all workers finished execution")
 	close(responses)
+	var statsAfter map[string]fileserver.ServerStats
+	if req.Churn {
+		statsAfter = clientServerStats(config, req)
+	}
 
 	// Close connections to servers
-	for i := range fsclients {
-		fsclients[i].CloseIdleConnections()
+	for _, transferers := range shards {
+		for _, t := range transferers {
+			t.CloseIdleConnections()
+		}
 	}
 
 	// Receive summary of worker responses
 	finalResp := <-summary
 	close(summary)
+	finalResp.ServerUsage = clientServerUsage(statsBefore, statsAfter)
 	return finalResp, nil
 }
 
+// clientServerStats retrieves a snapshot of the resource usage of each server
+// of the load request. The servers whose statistics cannot be retrieved, such
+// as servers which are not chasqui file servers, are omitted.
+func clientServerStats(config clientConfig, req *LoadRequest) map[string]fileserver.ServerStats {
+	c, err := fileserver.NewClient(req.UseHttp1, config.cert, config.key, config.ca)
+	if err != nil {
+		debug(1, "could not create client for retrieving server statistics: %s", err)
+		return nil
+	}
+	defer c.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stats := make(map[string]fileserver.ServerStats, len(req.ServerAddrs))
+	for _, server := range req.ServerAddrs {
+		s, err := c.ServerStats(ctx, server)
+		if err != nil {
+			debug(1, "could not retrieve statistics of server %s: %s", server, err)
+			continue
+		}
+		stats[server] = s
+	}
+	return stats
+}
+
+// clientServerUsage returns the resource usage of each server between two
+// snapshots of their statistics
+func clientServerUsage(before, after map[string]fileserver.ServerStats) map[string]ServerUsage {
+	if len(after) == 0 {
+		return nil
+	}
+	usage := make(map[string]ServerUsage, len(after))
+	for server, a := range after {
+		b, ok := before[server]
+		elapsed := a.Time.Sub(b.Time).Seconds()
+		if !ok || elapsed <= 0 {
+			continue
+		}
+		handshakes := a.Handshakes - b.Handshakes
+		usage[server] = ServerUsage{
+			CPU:               (a.CPUTime - b.CPUTime).Seconds() / elapsed,
+			Handshakes:        handshakes,
+			ResumedHandshakes: a.ResumedHandshakes - b.ResumedHandshakes,
+			HandshakeRate:     float64(handshakes) / elapsed,
+		}
+	}
+	return usage
+}
+
 // clientEmitRequests emits file download requests against the file servers. The emitted requests are
 // executed by workers
-func clientEmitRequests(config clientConfig, req *LoadRequest, fsclients []*fileserver.Client, requests chan *DownloadReq, responses chan *DownloadResp) {
+func clientEmitRequests(config clientConfig, req *LoadRequest, requests chan *DownloadReq, responses chan *DownloadResp) {
 	timeout := time.After(req.Duration)
 	numServers := len(req.ServerAddrs)
 	seqNumber := uint64(0)
 	notAfter := time.Now().Add(req.Duration)
+	chkMode, chkAlgo, _ := clientChecksumParams(req)
+	copyMode, _ := clientCopyMode(req)
+	sinkMode, _ := clientSinkMode(req)
+	sinkDir, _ := clientSinkDir(req)
 loop:
 	for {
 		seqNumber += 1
@@ -196,9 +393,16 @@ loop:
 		newreq := &DownloadReq{
 			seqNumber: seqNumber,
 			server:    req.ServerAddrs[s],
-			fsclient:  fsclients[s],
+			serverIdx: s,
 			fileID:    fmt.Sprintf("file-%d", seqNumber),
 			size:      uint64(req.MeanSize) + uint64(rand.NormFloat64()*float64(req.StdSize)),
+			chkMode:   chkMode,
+			chkAlgo:   chkAlgo,
+			copyMode:  copyMode,
+			peer:      req.ServerAddrs[(s+1)%numServers],
+			streams:   req.Streams,
+			sinkMode:  sinkMode,
+			sinkDir:   sinkDir,
 			notAfter:  notAfter,
 			replyTo:   responses,
 		}
@@ -215,18 +419,97 @@ loop:
 }
 
 func clientCollectResponses(numWorkers int, responses chan *DownloadResp, summary chan *LoadResponse) {
-	totalSize := float64(0) // MB
-	fileCount, errCount := uint64(0), uint64(0)
+	totalSize, wireSize := float64(0), float64(0) // MB
+	fileCount, errCount, interrupted := uint64(0), uint64(0), uint64(0)
+	decodeTime, redirectTime := time.Duration(0), time.Duration(0)
+	tokenTime := time.Duration(0)
+	redirects := uint64(0)
+	retries, resumed, recovered := uint64(0), uint64(0), uint64(0)
+	imbalance := time.Duration(0)
+	dnsTime, connectTime, tlsTime, firstByteTime := time.Duration(0), time.Duration(0), time.Duration(0), time.Duration(0)
+	newConns, reusedConns := uint64(0), uint64(0)
+	fullHandshakes, resumedHandshakes := uint64(0), uint64(0)
+	fullHandshakeTime, resumedHandshakeTime := time.Duration(0), time.Duration(0)
+	var handshakeTimes []time.Duration
+	proxiedFiles, proxyTunnels, proxyConnectTime := uint64(0), uint64(0), time.Duration(0)
+	protocols, remoteIPs := map[string]uint64{}, map[string]uint64{}
+	var profile []ProfileInterval
+	timeouts, stalls := uint64(0), uint64(0)
+	errClasses := map[string]uint64{}
+	throttleTime := time.Duration(0)
+	writeTime, networkTime := time.Duration(0), time.Duration(0)
+	corruptedFiles, corruptedRanges, corruptedBytes := uint64(0), uint64(0), uint64(0)
 	start := time.Now()
 	for resp := range responses {
+		timeouts += uint64(resp.timeouts)
+		stalls += uint64(resp.stalls)
+		if resp.corruptedRanges > 0 {
+			corruptedFiles += 1
+			corruptedRanges += uint64(resp.corruptedRanges)
+			corruptedBytes += uint64(resp.corruptedBytes)
+		}
+		if resp.retries > 0 {
+			retries += uint64(resp.retries)
+			resumed += uint64(resp.resumed)
+			if resp.err == nil {
+				recovered += 1
+			}
+		}
+		if resp.interrupted {
+			// Account for the data received until the test ended
+			interrupted += 1
+			totalSize += float64(resp.received) / float64(MB)
+			continue
+		}
 		if resp.err != nil {
 			errCount += 1
+			errClasses[errorClass(resp.err)] += 1
 			debug(1, "error from worker: seqNumber=%d %s\n", resp.seqNumber, resp.err)
 			continue
 		}
 		fileCount += 1
 		totalSize += float64(resp.size) / float64(MB)
+		wireSize += float64(resp.wireSize) / float64(MB)
+		decodeTime += resp.decodeTime
+		throttleTime += resp.throttleTime
+		writeTime += resp.writeTime
+		networkTime += resp.networkTime
+		redirects += uint64(resp.redirects)
+		redirectTime += resp.redirectTime
+		tokenTime += resp.tokenTime
+		imbalance += resp.imbalance
+		dnsTime += resp.dnsTime
+		connectTime += resp.connectTime
+		tlsTime += resp.tlsTime
+		fullHandshakes += uint64(resp.tlsHandshakes - resp.tlsResumed)
+		resumedHandshakes += uint64(resp.tlsResumed)
+		fullHandshakeTime += resp.tlsTime - resp.tlsResumedTime
+		resumedHandshakeTime += resp.tlsResumedTime
+		if resp.tlsHandshakes > 0 {
+			handshakeTimes = append(handshakeTimes, resp.tlsTime/time.Duration(resp.tlsHandshakes))
+		}
+		firstByteTime += resp.firstByteTime
+		if resp.reused {
+			reusedConns += 1
+		} else {
+			newConns += 1
+		}
+		if resp.proxied {
+			proxiedFiles += 1
+			if resp.proxyConnectTime > 0 {
+				proxyTunnels += 1
+				proxyConnectTime += resp.proxyConnectTime
+			}
+		}
+		if resp.protocol != "" {
+			protocols[resp.protocol] += 1
+		}
+		if resp.remoteIP != "" {
+			remoteIPs[resp.remoteIP] += 1
+		}
+		profile = addToProfile(profile, resp.samples)
 	}
+	sort.Slice(handshakeTimes, func(i, j int) bool { return handshakeTimes[i] < handshakeTimes[j] })
 	summary <- &LoadResponse{
 		Start:       start,
 		End:         time.Now(),
@@ -235,7 +518,85 @@ func clientCollectResponses(numWorkers int, responses chan *DownloadResp, summar
 		DataSize:    totalSize,
 		Rate:        float64(totalSize) / time.Since(start).Seconds(),
 		ErrCount:    errCount,
+		ErrClasses:  errClasses,
+		Interrupted: interrupted,
+
+		WireDataSize: wireSize,
+		DecodeTime:   decodeTime,
+		Redirects:    redirects,
+		RedirectTime: redirectTime,
+
+		TokenValidationTime: tokenTime,
+
+		Retries:   retries,
+		Resumed:   resumed,
+		Recovered: recovered,
+
+		StreamImbalance: imbalance,
+
+		DNSTime:               dnsTime,
+		ConnectTime:           connectTime,
+		TLSHandshakeTime:      tlsTime,
+		FirstResponseByteTime: firstByteTime,
+		NewConns:              newConns,
+		ReusedConns:           reusedConns,
+		FullHandshakes:        fullHandshakes,
+		ResumedHandshakes:     resumedHandshakes,
+		FullHandshakeTime:     fullHandshakeTime,
+		ResumedHandshakeTime:  resumedHandshakeTime,
+		HandshakeRate:         float64(fullHandshakes+resumedHandshakes) / time.Since(start).Seconds(),
+		HandshakeP50:          percentile(handshakeTimes, 50),
+		HandshakeP90:          percentile(handshakeTimes, 90),
+		HandshakeP99:          percentile(handshakeTimes, 99),
+		ProxiedFiles:          proxiedFiles,
+		ProxyTunnels:          proxyTunnels,
+		ProxyConnectTime:      proxyConnectTime,
+		Protocols:             protocols,
+		RemoteIPs:             remoteIPs,
+
+		Profile: profile,
+
+		Timeouts: timeouts,
+		Stalls:   stalls,
+
+		ThrottleTime: throttleTime,
+
+		WriteTime:   writeTime,
+		NetworkTime: networkTime,
+
+		CorruptedFiles:  corruptedFiles,
+		CorruptedRanges: corruptedRanges,
+		CorruptedBytes:  corruptedBytes,
+	}
+}
+
+// percentile returns the p-th percentile of the sorted durations, using the
+// nearest-rank method, or zero if there are none
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
 	}
+	return sorted[rank-1]
+}
+
+// addToProfile adds the bytes received during each sampling interval of a
+// download to the corresponding interval of the profile
+func addToProfile(profile []ProfileInterval, samples []fileserver.ThroughputSample) []ProfileInterval {
+	prev := fileserver.ThroughputSample{}
+	for i, s := range samples {
+		if i == len(profile) {
+			profile = append(profile, ProfileInterval{})
+		}
+		profile[i].Downloads += 1
+		profile[i].Bytes += uint64(s.Bytes - prev.Bytes)
+		profile[i].Elapsed += s.Elapsed - prev.Elapsed
+		prev = s
+	}
+	return profile
 }
 
 type LoadRequest struct {
@@ -254,6 +615,114 @@ type LoadRequest struct {
 	// Mean and std of the file size to request to the servers (bytes)
 	MeanSize uint64
 	StdSize  uint64
+
+	// Checksum algorithm to use for each download operation (e.g. "sha256").
+	// If empty, no checksum is computed
+	ChecksumAlgorithm string
+
+	// Where the checksum is computed: "client", "server" or "both" (the default)
+	ChecksumMode string
+
+	// HTTP fields used for negotiating the checksum with the servers: "custom"
+	// (the default), "repr-digest" (RFC 9530) or "digest" (RFC 3230)
+	DigestFields string
+
+	// Request compressible file contents to the servers
+	Compressible bool
+
+	// Request deterministic file contents to the servers and verify each byte
+	// received. It overrides Compressible
+	Verify bool
+
+	// Content codings accepted by the clients (e.g. "zstd, gzip"). If empty,
+	// the servers send unencoded file contents
+	AcceptEncoding string
+
+	// Request the servers to send the length and the checksum of the file
+	// contents as headers instead of as trailers
+	UpfrontLength bool
+
+	// Name of the backend used for transferring files, as registered with
+	// RegisterBackend. The default is "fileserver", for chasqui file servers
+	Backend string
+
+	// Bucket, template of the keys and region of the objects downloaded by
+	// the "s3" backend. See fileserver.S3Config
+	S3Bucket      string
+	S3KeyTemplate string
+	S3Region      string
+
+	// Resume the TLS sessions established with the servers when establishing
+	// new connections, provided the servers issue session tickets
+	SessionResumption bool
+
+	// Establish a new connection for each download, for measuring the rate
+	// at which the servers accept new connections. The clients report the
+	// CPU consumed by the servers during the test
+	Churn bool
+
+	// URL of the forward proxy the clients send their requests via. If empty,
+	// the proxy is selected by the environment of the client processes. See
+	// fileserver.ParseProxyURL
+	Proxy string
+
+	// Kind of transfer: "download" (the default) for downloading files from
+	// the servers or "tpc-pull" and "tpc-push" for requesting each server to
+	// perform third-party copies with another server
+	TransferMode string
+
+	// Maximum number of attempts of each download
+	MaxAttempts int
+
+	// Number of streams each file is downloaded with
+	Streams int
+
+	// Interval between the samples of the number of bytes received during
+	// each download. If zero, downloads are not sampled
+	SampleInterval time.Duration
+
+	// Number of TCP connections each client opens to each server. If zero,
+	// the workers share a single transport per server
+	ConnsPerServer int
+
+	// Each worker uses its own transport, and therefore its own connection
+	// to each server
+	TransportPerWorker bool
+
+	// Maximum durations of the establishment of each connection, of the TLS
+	// handshake, of the wait for the first byte of each response and of the
+	// periods without receiving data while downloading a file. Zero means no
+	// timeout
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	FirstByteTimeout    time.Duration
+	StallTimeout        time.Duration
+
+	// Maximum rates at which each worker and the whole client process receive
+	// data (bytes/sec). Zero means no limit
+	WorkerRate  float64
+	ProcessRate float64
+
+	// Where the clients write the downloaded data: "discard" (the default),
+	// "buffered", "fsync", "direct" or "tmpfs", and the directory on the
+	// client hosts where the files are written. The directory of the "tmpfs"
+	// mode defaults to /dev/shm
+	Sink    string
+	SinkDir string
+}
+
+// ServerUsage is the resource usage of a server during a test, as observed by
+// a client
+type ServerUsage struct {
+	// Average number of CPU cores used by the server process
+	CPU float64
+
+	// Number of TLS handshakes completed by the server, including those with
+	// other clients, of those which resumed a session and number of
+	// handshakes per second
+	Handshakes        uint64
+	ResumedHandshakes uint64
+	HandshakeRate     float64
 }
 
 type LoadResponse struct {
@@ -273,8 +742,129 @@ type LoadResponse struct {
 	// Download rate for this test: MB/sec
 	Rate float64
 
-	// Number of errors observed in this test
-	ErrCount uint64
+	// Number of errors observed in this test and number of errors per class:
+	// "status <code>" for unexpected HTTP status codes, "checksum mismatch",
+	// "content mismatch", "length mismatch", "missing trailer", "transport",
+	// "timeout", "stall" or "other"
+	ErrCount   uint64
+	ErrClasses map[string]uint64
+
+	// Number of downloads aborted because the test ended. The data they
+	// received is included in DataSize
+	Interrupted uint64
+
+	// Volume of data received from the network in this test (in MB). It is
+	// smaller than DataSize if the servers applied a content coding
+	WireDataSize float64
+
+	// Cumulated time spent decoding the downloaded data
+	DecodeTime time.Duration
+
+	// Number of redirections followed and cumulated time spent following them
+	Redirects    uint64
+	RedirectTime time.Duration
+
+	// Cumulated time the servers reported spending validating the bearer token
+	// of the requests
+	TokenValidationTime time.Duration
+
+	// Number of retried download attempts, of those which resumed an
+	// interrupted download and number of downloads which succeeded after
+	// being retried
+	Retries   uint64
+	Resumed   uint64
+	Recovered uint64
+
+	// Cumulated time elapsed between the end of the first and of the last
+	// stream of the downloads performed with several streams
+	StreamImbalance time.Duration
+
+	// Cumulated durations of the phases of the requests of the downloaded
+	// files: DNS resolution, TCP connection establishment, TLS handshake and
+	// time elapsed since the request was written until the first byte of the
+	// response was received
+	DNSTime               time.Duration
+	ConnectTime           time.Duration
+	TLSHandshakeTime      time.Duration
+	FirstResponseByteTime time.Duration
+
+	// Number of downloaded files requested over a new connection and over a
+	// connection reused from a previous request
+	NewConns    uint64
+	ReusedConns uint64
+
+	// Number of full TLS handshakes and of handshakes which resumed a session
+	// performed for the downloaded files, and cumulated time spent in each
+	// kind of handshake
+	FullHandshakes       uint64
+	ResumedHandshakes    uint64
+	FullHandshakeTime    time.Duration
+	ResumedHandshakeTime time.Duration
+
+	// Number of TLS handshakes per second performed for the downloaded files
+	// and percentiles of the duration of a handshake
+	HandshakeRate float64
+	HandshakeP50  time.Duration
+	HandshakeP90  time.Duration
+	HandshakeP99  time.Duration
+
+	// Resource usage of each server during the test, if requested via the
+	// Churn field of the load request and reported by the server
+	ServerUsage map[string]ServerUsage
+
+	// Number of downloaded files requested via a forward proxy, number of
+	// tunnels established through the proxy for them and cumulated time spent
+	// establishing those tunnels
+	ProxiedFiles     uint64
+	ProxyTunnels     uint64
+	ProxyConnectTime time.Duration
+
+	// Number of downloaded files per protocol and TLS parameters negotiated
+	// (e.g. "HTTP/2.0 TLS 1.3 TLS_AES_128_GCM_SHA256") and per IP address of
+	// the server which served them
+	Protocols map[string]uint64
+	RemoteIPs map[string]uint64
+
+	// Bytes received by the downloaded files during each sampling interval
+	// since their start, if downloads were sampled
+	Profile []ProfileInterval
+
+	// Number of download attempts aborted because the establishment of the
+	// connection, the TLS handshake or the wait for the response timed out,
+	// and number of those aborted because they stalled while receiving the
+	// file contents
+	Timeouts uint64
+	Stalls   uint64
+
+	// Cumulated time the downloaded files spent waiting for the receive rate
+	// limits
+	ThrottleTime time.Duration
+
+	// Cumulated time spent writing the downloaded files to the sink, including
+	// flushing and closing them, and cumulated time spent receiving them, not
+	// including the writes
+	WriteTime   time.Duration
+	NetworkTime time.Duration
+
+	// Number of downloaded files whose contents differ from the expected ones,
+	// along with their number of ranges of consecutive corrupted bytes and
+	// of corrupted bytes, if the clients verified the contents
+	CorruptedFiles  uint64
+	CorruptedRanges uint64
+	CorruptedBytes  uint64
+}
+
+// ProfileInterval accounts for the data received by the downloads during a
+// sampling interval
+type ProfileInterval struct {
+	// Number of downloads in progress during the interval
+	Downloads uint64
+
+	// Bytes received by those downloads and cumulated duration of the
+	// interval for each of them. The last interval of a download is shorter
+	// than the sampling interval
+	Bytes   uint64
+	Elapsed time.Duration
 }
 
 func clientStopRequestHandler(w http.ResponseWriter, r *http.Request) {
@@ -292,7 +882,7 @@ func clientUsage(cmd string, f *os.File) {
 	const clientTempl = `
 USAGE:
 {{.Tab1}}{{.AppName}} {{.SubCmd}} [-addr=<network address>] [-ca=<file>] [-cert=<file>]
-{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-key=<file>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-key=<file>] [-token=<file>] [-s3credentials=<file>]
 {{.Tab1}}{{.AppName}} {{.SubCmd}} -help
 
 DESCRIPTION:
@@ -319,13 +909,32 @@ OPTIONS:
 {{.Tab1}}-cert=<file>
 {{.Tab2}}path of the PEM-formatted file which contains the certificate this
 {{.Tab2}}client process uses for identifying itself to the file server.
+{{.Tab2}}This may be a grid proxy file, such as the one created by
+{{.Tab2}}'voms-proxy-init', which contains an RFC 3820 proxy certificate, its
+{{.Tab2}}private key and the certificate chain it was issued by.
 {{.Tab2}}Default: "{{.DefaultClientCert}}"
 
 {{.Tab1}}-key=<file>
 {{.Tab2}}path of the PEM-formatted file which contains the private key of
-{{.Tab2}}the certificate specified with the '-cert' option.
+{{.Tab2}}the certificate specified with the '-cert' option. If not specified,
+{{.Tab2}}the private key is read from the file specified with '-cert'.
 {{.Tab2}}Default: "{{.DefaultClientKey}}"
 
+{{.Tab1}}-token=<file>
+{{.Tab2}}path of the file which contains the bearer token, such as a WLCG
+{{.Tab2}}token, this client process presents to the file servers in the
+{{.Tab2}}'Authorization' header of its requests. The file is read again for
+{{.Tab2}}each test, so the token can be renewed between tests.
+{{.Tab2}}Default: "{{.DefaultClientToken}}"
+
+{{.Tab1}}-s3credentials=<file>
+{{.Tab2}}path of the file which contains the access key identifier, the secret
+{{.Tab2}}access key and, optionally, the session token, separated by white
+{{.Tab2}}space, this client process signs its requests to S3 servers with,
+{{.Tab2}}when the driver selects the 's3' backend. The file is read again for
+{{.Tab2}}each test.
+{{.Tab2}}Default: requests to S3 servers are sent anonymously.
+
 {{.Tab1}}-help
 {{.Tab2}}print this help
 `
@@ -335,5 +944,6 @@ OPTIONS:
 	tmplFields["DefaultClientCA"] = defaultClientCA
 	tmplFields["DefaultClientCert"] = defaultClientCert
 	tmplFields["DefaultClientKey"] = defaultClientKey
+	tmplFields["DefaultClientToken"] = defaultClientToken
 	render(clientTempl, tmplFields, f)
 }
@@ -10,15 +10,23 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/airnandez/chasqui/fileserver"
 )
 
 const (
 	defaultDuration     time.Duration = time.Duration(10) * time.Second
 	defaultMeanFileSize int           = 100 // MB
 	defaultStdFileSize  float64       = 0.2 // [0..1]
+	defaultChecksumMode string        = "both"
+	defaultDigestFields string        = "custom"
+	defaultTransferMode string        = "download"
+	defaultBackend      string        = "fileserver"
+	defaultSinkMode     string        = "discard"
 )
 
 type driverConfig struct {
@@ -31,6 +39,37 @@ type driverConfig struct {
 	http1       bool
 	meanSize    int
 	stdSize     float64
+	checksum    string
+	chkMode     string
+	digest      string
+	compress    bool
+	verify      bool
+	encoding    string
+	upfront     bool
+	mode        string
+	backend     string
+	s3Bucket    string
+	s3Key       string
+	s3Region    string
+	proxy       string
+	resumption  bool
+	churn       bool
+	attempts    int
+	streams     int
+	sample      time.Duration
+	conns       int
+	perWorker   bool
+
+	dialTimeout      time.Duration
+	tlsTimeout       time.Duration
+	firstByteTimeout time.Duration
+	stallTimeout     time.Duration
+
+	workerRate float64
+	clientRate float64
+
+	sink    string
+	sinkDir string
 }
 
 func driverCmd() command {
@@ -45,6 +84,34 @@ func driverCmd() command {
 	fset.IntVar(&config.meanSize, "size", defaultMeanFileSize, "")
 	fset.IntVar(&config.concurrency, "concurrency", 0, "")
 	fset.BoolVar(&config.http1, "http1", false, "")
+	fset.StringVar(&config.checksum, "checksum", "", "")
+	fset.StringVar(&config.chkMode, "checksummode", defaultChecksumMode, "")
+	fset.StringVar(&config.digest, "digest", defaultDigestFields, "")
+	fset.BoolVar(&config.compress, "compressible", false, "")
+	fset.BoolVar(&config.verify, "verify", false, "")
+	fset.StringVar(&config.encoding, "encoding", "", "")
+	fset.BoolVar(&config.upfront, "upfrontlength", false, "")
+	fset.StringVar(&config.mode, "mode", defaultTransferMode, "")
+	fset.StringVar(&config.backend, "backend", defaultBackend, "")
+	fset.StringVar(&config.s3Bucket, "s3bucket", "", "")
+	fset.StringVar(&config.s3Key, "s3key", fileserver.DefaultS3KeyTemplate, "")
+	fset.StringVar(&config.s3Region, "s3region", fileserver.DefaultS3Region, "")
+	fset.StringVar(&config.proxy, "proxy", "", "")
+	fset.BoolVar(&config.resumption, "resumption", false, "")
+	fset.BoolVar(&config.churn, "churn", false, "")
+	fset.IntVar(&config.attempts, "attempts", 1, "")
+	fset.IntVar(&config.streams, "streams", 1, "")
+	fset.DurationVar(&config.sample, "sample", 0, "")
+	fset.IntVar(&config.conns, "conns", 0, "")
+	fset.BoolVar(&config.perWorker, "transportperworker", false, "")
+	fset.DurationVar(&config.dialTimeout, "dialtimeout", 0, "")
+	fset.DurationVar(&config.tlsTimeout, "tlstimeout", 0, "")
+	fset.DurationVar(&config.firstByteTimeout, "firstbytetimeout", 0, "")
+	fset.DurationVar(&config.stallTimeout, "stalltimeout", 0, "")
+	fset.Float64Var(&config.workerRate, "workerrate", 0, "")
+	fset.Float64Var(&config.clientRate, "clientrate", 0, "")
+	fset.StringVar(&config.sink, "sink", defaultSinkMode, "")
+	fset.StringVar(&config.sinkDir, "sinkdir", "", "")
 	fset.BoolVar(&config.help, "help", false, "")
 	run := func(args []string) error {
 		fset.Usage = func() { driverUsage(args[0], os.Stderr) }
@@ -62,6 +129,11 @@ func driverRun(cmdName string, config driverConfig) error {
 	if config.duration < 0 {
 		config.duration *= -1
 	}
+	if len(config.checksum) > 0 {
+		if _, err := fileserver.ChecksumAlgorithmByName(config.checksum); err != nil {
+			return err
+		}
+	}
 	errlog = setErrlog(cmdName)
 	debug(1, "running driver:")
 	debug(1, "   clients='%s'\n", config.clients)
@@ -70,6 +142,39 @@ func driverRun(cmdName string, config driverConfig) error {
 	debug(1, "   concurrency=%d\n", config.concurrency)
 	debug(1, "   meanSize=%d MB\n", config.meanSize)
 	debug(1, "   http1=%t\n", config.http1)
+	debug(1, "   checksum='%s'\n", config.checksum)
+	debug(1, "   checksummode='%s'\n", config.chkMode)
+	debug(1, "   digest='%s'\n", config.digest)
+	debug(1, "   compressible=%t\n", config.compress)
+	debug(1, "   verify=%t\n", config.verify)
+	debug(1, "   encoding='%s'\n", config.encoding)
+	debug(1, "   upfrontlength=%t\n", config.upfront)
+	debug(1, "   mode='%s'\n", config.mode)
+	debug(1, "   backend='%s'\n", config.backend)
+	debug(1, "   s3bucket='%s'\n", config.s3Bucket)
+	debug(1, "   s3key='%s'\n", config.s3Key)
+	debug(1, "   s3region='%s'\n", config.s3Region)
+	debug(1, "   resumption=%t\n", config.resumption)
+	debug(1, "   churn=%t\n", config.churn)
+	if u, err := fileserver.ParseProxyURL(config.proxy); err == nil {
+		// Do not reveal the proxy password
+		debug(1, "   proxy='%s'\n", u.Redacted())
+	} else {
+		debug(1, "   proxy='%s'\n", config.proxy)
+	}
+	debug(1, "   attempts=%d\n", config.attempts)
+	debug(1, "   streams=%d\n", config.streams)
+	debug(1, "   sample='%s'\n", config.sample)
+	debug(1, "   conns=%d\n", config.conns)
+	debug(1, "   transportperworker=%t\n", config.perWorker)
+	debug(1, "   dialtimeout='%s'\n", config.dialTimeout)
+	debug(1, "   tlstimeout='%s'\n", config.tlsTimeout)
+	debug(1, "   firstbytetimeout='%s'\n", config.firstByteTimeout)
+	debug(1, "   stalltimeout='%s'\n", config.stallTimeout)
+	debug(1, "   workerrate=%.2f MB/sec\n", config.workerRate)
+	debug(1, "   clientrate=%.2f MB/sec\n", config.clientRate)
+	debug(1, "   sink='%s'\n", config.sink)
+	debug(1, "   sinkdir='%s'\n", config.sinkDir)
 
 	// Prepare collector of execution reports
 	clientAddrs := splitAndClean(config.clients)
@@ -87,6 +192,39 @@ func driverRun(cmdName string, config driverConfig) error {
 		MeanSize:    meanSize,
 		StdSize:     uint64(config.stdSize * float64(meanSize)),
 		UseHttp1:    config.http1,
+
+		ChecksumAlgorithm: config.checksum,
+		ChecksumMode:      config.chkMode,
+		DigestFields:      config.digest,
+		Compressible:      config.compress,
+		Verify:            config.verify,
+		AcceptEncoding:    config.encoding,
+		UpfrontLength:     config.upfront,
+		TransferMode:      config.mode,
+		Backend:           config.backend,
+		S3Bucket:          config.s3Bucket,
+		S3KeyTemplate:     config.s3Key,
+		S3Region:          config.s3Region,
+		Proxy:             config.proxy,
+		SessionResumption: config.resumption,
+		Churn:             config.churn,
+		MaxAttempts:       config.attempts,
+		Streams:           config.streams,
+		SampleInterval:    config.sample,
+
+		ConnsPerServer:     config.conns,
+		TransportPerWorker: config.perWorker,
+
+		DialTimeout:         config.dialTimeout,
+		TLSHandshakeTimeout: config.tlsTimeout,
+		FirstByteTimeout:    config.firstByteTimeout,
+		StallTimeout:        config.stallTimeout,
+
+		WorkerRate:  config.workerRate * float64(MB),
+		ProcessRate: config.clientRate * float64(MB),
+
+		Sink:    config.sink,
+		SinkDir: config.sinkDir,
 	}
 	var sendGroup sync.WaitGroup
 	for _, cli := range clientAddrs {
@@ -171,6 +309,77 @@ func driverCollectLoadReports(n int, reports chan *LoadReport, wg *sync.WaitGrou
 			fmt.Printf("\tdata volume:      %.2f MB\n", rep.resp.DataSize)
 			fmt.Printf("\tdownload rate:    %.2f MB/sec\n", rep.resp.Rate)
 			fmt.Printf("\terrors:           %d\n", rep.resp.ErrCount)
+			printCounts("error", "errors", rep.resp.ErrClasses)
+			if rep.resp.Interrupted > 0 {
+				fmt.Printf("\tinterrupted:      %d\n", rep.resp.Interrupted)
+			}
+			if rep.req.Verify {
+				fmt.Printf("\tcorrupted files:  %d (%d ranges, %d bytes)\n", rep.resp.CorruptedFiles, rep.resp.CorruptedRanges, rep.resp.CorruptedBytes)
+			}
+			if rep.req.Streams > 1 && rep.resp.NumFiles > 0 {
+				fmt.Printf("\tstreams:          %d\n", rep.req.Streams)
+				fmt.Printf("\tstream imbalance: %s (avg)\n", rep.resp.StreamImbalance/time.Duration(rep.resp.NumFiles))
+			}
+			if rep.req.Sink != "" && rep.req.Sink != "discard" && rep.resp.NumFiles > 0 {
+				fmt.Printf("\twrite time:       %s (avg)\n", rep.resp.WriteTime/time.Duration(rep.resp.NumFiles))
+				fmt.Printf("\tnetwork time:     %s (avg)\n", rep.resp.NetworkTime/time.Duration(rep.resp.NumFiles))
+			}
+			if rep.resp.ThrottleTime > 0 && rep.resp.NumFiles > 0 {
+				fmt.Printf("\tthrottle time:    %s (avg)\n", rep.resp.ThrottleTime/time.Duration(rep.resp.NumFiles))
+			}
+			if rep.resp.Timeouts > 0 || rep.resp.Stalls > 0 {
+				fmt.Printf("\ttimeouts:         %d\n", rep.resp.Timeouts)
+				fmt.Printf("\tstalls:           %d\n", rep.resp.Stalls)
+			}
+			if rep.resp.Retries > 0 {
+				fmt.Printf("\tretries:          %d\n", rep.resp.Retries)
+				fmt.Printf("\tresumed:          %d\n", rep.resp.Resumed)
+				fmt.Printf("\trecovered:        %d\n", rep.resp.Recovered)
+			}
+			if rep.req.AcceptEncoding != "" {
+				fmt.Printf("\twire volume:      %.2f MB\n", rep.resp.WireDataSize)
+				fmt.Printf("\tdecoding time:    %s\n", rep.resp.DecodeTime)
+			}
+			if rep.resp.Redirects > 0 {
+				fmt.Printf("\tredirects:        %d\n", rep.resp.Redirects)
+				fmt.Printf("\tredirect latency: %s (avg)\n", rep.resp.RedirectTime/time.Duration(rep.resp.NumFiles))
+			}
+			if rep.resp.TokenValidationTime > 0 && rep.resp.NumFiles > 0 {
+				fmt.Printf("\ttoken validation: %s (avg)\n", rep.resp.TokenValidationTime/time.Duration(rep.resp.NumFiles))
+			}
+			if rep.resp.NumFiles > 0 {
+				n := time.Duration(rep.resp.NumFiles)
+				fmt.Printf("\tdns resolution:   %s (avg)\n", rep.resp.DNSTime/n)
+				fmt.Printf("\ttcp connect:      %s (avg)\n", rep.resp.ConnectTime/n)
+				fmt.Printf("\ttls handshake:    %s (avg)\n", rep.resp.TLSHandshakeTime/n)
+				fmt.Printf("\tfirst byte wait:  %s (avg)\n", rep.resp.FirstResponseByteTime/n)
+				fmt.Printf("\tconnections:      %d new, %d reused\n", rep.resp.NewConns, rep.resp.ReusedConns)
+			}
+			if rep.resp.FullHandshakes > 0 {
+				fmt.Printf("\ttls full:         %d handshakes (%s avg)\n", rep.resp.FullHandshakes, rep.resp.FullHandshakeTime/time.Duration(rep.resp.FullHandshakes))
+			}
+			if rep.resp.ResumedHandshakes > 0 {
+				fmt.Printf("\ttls resumed:      %d handshakes (%s avg)\n", rep.resp.ResumedHandshakes, rep.resp.ResumedHandshakeTime/time.Duration(rep.resp.ResumedHandshakes))
+			}
+			if rep.req.Churn {
+				fmt.Printf("\thandshake rate:   %.2f handshakes/sec\n", rep.resp.HandshakeRate)
+				fmt.Printf("\thandshake time:   p50 %s, p90 %s, p99 %s\n", rep.resp.HandshakeP50, rep.resp.HandshakeP90, rep.resp.HandshakeP99)
+				printServerUsage(rep.resp.ServerUsage)
+			}
+			if rep.resp.ProxiedFiles > 0 {
+				fmt.Printf("\tvia proxy:        %d files\n", rep.resp.ProxiedFiles)
+				if rep.resp.ProxyTunnels > 0 {
+					fmt.Printf("\tproxy connect:    %s (avg over %d tunnels)\n", rep.resp.ProxyConnectTime/time.Duration(rep.resp.ProxyTunnels), rep.resp.ProxyTunnels)
+				}
+			}
+			printCounts("protocol", "files", rep.resp.Protocols)
+			for i, p := range rep.resp.Profile {
+				if p.Elapsed > 0 {
+					elapsed := time.Duration(i+1) * rep.req.SampleInterval
+					fmt.Printf("\tthroughput:       +%s %.2f MB/sec (%d files)\n", elapsed, float64(p.Bytes)/float64(MB)/p.Elapsed.Seconds(), p.Downloads)
+				}
+			}
+			printCounts("server ip", "files", rep.resp.RemoteIPs)
 			// debug(1, "received response from client %s %#v: ", rep.client, rep.resp)
 		}
 	}
@@ -178,6 +387,32 @@ func driverCollectLoadReports(n int, reports chan *LoadReport, wg *sync.WaitGrou
 	printSummary(results)
 }
 
+// printCounts prints the count for each key of counts, sorted by key, followed
+// by the unit of the count (e.g. "files")
+func printCounts(label, unit string, counts map[string]uint64) {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("\t%-17s %s (%d %s)\n", label+":", k, counts[k], unit)
+	}
+}
+
+// printServerUsage prints the resource usage of each server, sorted by server
+func printServerUsage(usage map[string]ServerUsage) {
+	servers := make([]string, 0, len(usage))
+	for s := range usage {
+		servers = append(servers, s)
+	}
+	sort.Strings(servers)
+	for _, s := range servers {
+		u := usage[s]
+		fmt.Printf("\tserver usage:     %s %.2f cores (%d handshakes, %.2f/sec)\n", s, u.CPU, u.Handshakes, u.HandshakeRate)
+	}
+}
+
 // printSummary prints a summary of the client reports
 func printSummary(results map[string]*LoadReport) {
 	var (
@@ -186,6 +421,8 @@ func printSummary(results map[string]*LoadReport) {
 		dataSize  float64
 		numFiles  uint64
 		numErrors int
+		churn     bool
+		hsRate    float64
 	)
 	for _, rep := range results {
 		if rep.err != nil {
@@ -201,6 +438,10 @@ func printSummary(results map[string]*LoadReport) {
 		}
 		dataSize += rep.resp.DataSize
 		numFiles += rep.resp.NumFiles
+		if rep.req.Churn {
+			churn = true
+			hsRate += rep.resp.HandshakeRate
+		}
 	}
 	rate := dataSize / end.Sub(start).Seconds()
 	fmt.Printf("Summary:\n")
@@ -208,6 +449,9 @@ func printSummary(results map[string]*LoadReport) {
 	fmt.Printf("   data volume:         %.2f MB\n", dataSize)
 	fmt.Printf("   avg file size:       %.2f MB\n", float64(dataSize)/float64(numFiles))
 	fmt.Printf("   download rate:       %.2f MB/sec\n", rate)
+	if churn {
+		fmt.Printf("   handshake rate:      %.2f handshakes/sec\n", hsRate)
+	}
 	if numErrors > 0 {
 		fmt.Printf("   download errors:       %d\n", numErrors)
 	}
@@ -219,6 +463,19 @@ func driverUsage(cmd string, f *os.File) {
 USAGE:
 {{.Tab1}}{{.AppName}} {{.SubCmd}} [-clients=<network addresses>] [-servers=<network addresses>]
 {{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-duration=duration] [-concurrency=integer] [-http1]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-conns=integer | -transportperworker]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-checksum=<algorithm>] [-checksummode=<mode>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-digest=<fields>] [-compressible] [-verify]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-encoding=<codings>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-upfrontlength] [-mode=<transfer mode>] [-backend=<name>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-s3bucket=<name>] [-s3key=<template>] [-s3region=<region>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-proxy=<URL>] [-resumption] [-churn]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-attempts=integer]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-streams=integer] [-sample=<duration>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-dialtimeout=<duration>] [-tlstimeout=<duration>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-firstbytetimeout=<duration>] [-stalltimeout=<duration>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-workerrate=<MB/sec>] [-clientrate=<MB/sec>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-sink=<mode>] [-sinkdir=<directory>]
 {{.Tab1}}{{.AppName}} {{.SubCmd}} -help
 
 DESCRIPTION:
@@ -263,6 +520,215 @@ OPTIONS:
 {{.Tab2}}specifies that the protocol to be used for downloading files from the
 {{.Tab2}}server is HTTP1.1 instead ofthe default HTTP/2.
 
+{{.Tab1}}-conns=integer
+{{.Tab2}}specifies the number of TCP connections each client opens to each
+{{.Tab2}}server. The workers of the client are evenly distributed among as
+{{.Tab2}}many transports, each one using a single connection per server. With
+{{.Tab2}}HTTP/2 the requests of the workers sharing a transport are multiplexed
+{{.Tab2}}onto its connection, while with '-http1' they wait for the connection
+{{.Tab2}}to become available.
+{{.Tab2}}Default: a single transport per server, which opens one connection
+{{.Tab2}}with HTTP/2 and one connection per concurrent download with '-http1'.
+
+{{.Tab1}}-transportperworker
+{{.Tab2}}specifies that each worker of the clients uses its own transport, so
+{{.Tab2}}that each concurrent download uses its own connection to the server,
+{{.Tab2}}with both HTTP/2 and '-http1'. This option cannot be combined with
+{{.Tab2}}'-conns'.
+
+{{.Tab1}}-checksum=<algorithm>
+{{.Tab2}}specifies the algorithm used for computing the checksum of the
+{{.Tab2}}contents of each downloaded file. Accepted values are:
+{{.Tab2}}{{.ChecksumNames}}.
+{{.Tab2}}Default: no checksum is computed.
+
+{{.Tab1}}-checksummode=<mode>
+{{.Tab2}}specifies where the checksum requested with the '-checksum' option
+{{.Tab2}}is computed. Accepted values are 'client', 'server' or 'both'. With
+{{.Tab2}}'both', the checksum computed by the client is verified against the
+{{.Tab2}}one computed by the server.
+{{.Tab2}}Default: {{.DefaultChecksumMode}}
+
+{{.Tab1}}-digest=<fields>
+{{.Tab2}}specifies the HTTP fields used for requesting the checksum to the
+{{.Tab2}}server and for receiving its value. Accepted values are 'custom' for
+{{.Tab2}}the chasqui-specific 'checksum' query parameter, 'repr-digest' for
+{{.Tab2}}the 'Want-Repr-Digest' and 'Repr-Digest' fields (RFC 9530) and
+{{.Tab2}}'digest' for the 'Want-Digest' and 'Digest' fields (RFC 3230). Only
+{{.Tab2}}sha256, sha512, md5, adler32 and crc32c can be negotiated via the
+{{.Tab2}}standard fields. The clients request a single algorithm, the one
+{{.Tab2}}specified with '-checksum', without fallback, so downloads from a
+{{.Tab2}}server which does not support it fail with a missing trailer error.
+{{.Tab2}}Default: {{.DefaultDigestFields}}
+
+{{.Tab1}}-compressible
+{{.Tab2}}specifies that the servers must send highly compressible file
+{{.Tab2}}contents instead of the default random (i.e. incompressible) contents.
+
+{{.Tab1}}-verify
+{{.Tab2}}specifies that the servers must send deterministic file contents,
+{{.Tab2}}which look random but are known in advance, and that the clients must
+{{.Tab2}}verify each byte they receive against them. A download which receives
+{{.Tab2}}corrupted bytes fails and the clients report the number of corrupted
+{{.Tab2}}files, byte ranges and bytes. This option overrides '-compressible'.
+
+{{.Tab1}}-encoding=<codings>
+{{.Tab2}}list of comma-separated content codings the clients accept, in the
+{{.Tab2}}syntax of the 'Accept-Encoding' HTTP field, for instance 'zstd, gzip'
+{{.Tab2}}or 'gzip;q=1, zstd;q=0.5'. The servers only encode compressible
+{{.Tab2}}contents (see option '-compressible'). Supported codings are 'gzip'
+{{.Tab2}}and 'zstd'.
+{{.Tab2}}Default: no encoding.
+
+{{.Tab1}}-upfrontlength
+{{.Tab2}}specifies that the servers must send the length of the file contents
+{{.Tab2}}in the 'Content-Length' header and the checksum, if any, as a header
+{{.Tab2}}instead of the default trailers, which may be dropped by proxies.
+{{.Tab2}}Since the length of encoded contents is not known in advance, this
+{{.Tab2}}option disables content encoding.
+
+{{.Tab1}}-mode=<transfer mode>
+{{.Tab2}}specifies the kind of transfers the clients perform. With 'download'
+{{.Tab2}}the clients download files from the servers. With 'tpc-pull' and
+{{.Tab2}}'tpc-push' the clients request each server to perform third-party
+{{.Tab2}}copies with another server in the list specified with the '-servers'
+{{.Tab2}}option, by pulling the files from or pushing them to that server. The
+{{.Tab2}}servers must be started with the '-tpc' option.
+{{.Tab2}}Default: {{.DefaultTransferMode}}
+
+{{.Tab1}}-backend=<name>
+{{.Tab2}}specifies the backend the clients use for transferring files, which
+{{.Tab2}}determines the protocol spoken with the servers. Supported backends
+{{.Tab2}}are: {{.BackendNames}}. With 'raw' and 'raw-tls' the clients
+{{.Tab2}}download files with a minimal length-prefixed protocol over TCP or TLS,
+{{.Tab2}}respectively, from the raw protocol addresses of the servers (see the
+{{.Tab2}}'-raw-addr' and '-raw-tls-addr' options of the servers), which must be
+{{.Tab2}}specified with '-servers'. Only checksums computed by the clients and
+{{.Tab2}}a single stream are supported by these backends.
+{{.Tab2}}Default: {{.DefaultBackend}}
+
+{{.Tab1}}-s3bucket=<name>
+{{.Tab2}}specifies the bucket of the objects the clients download with the
+{{.Tab2}}'s3' backend, which sends GET requests for '/<bucket>/<key>' signed
+{{.Tab2}}with AWS Signature Version 4. Chasqui servers serve such objects if
+{{.Tab2}}started with the '-s3' option. Only checksums computed by the clients
+{{.Tab2}}are supported.
+
+{{.Tab1}}-s3key=<template>
+{{.Tab2}}specifies the template of the keys of the objects downloaded with the
+{{.Tab2}}'s3' backend, where '{id}' and '{size}' are replaced by the identifier
+{{.Tab2}}and the size in bytes of each file.
+{{.Tab2}}Default: {{.DefaultS3KeyTemplate}}
+
+{{.Tab1}}-s3region=<region>
+{{.Tab2}}specifies the region the requests of the 's3' backend are signed for.
+{{.Tab2}}Default: {{.DefaultS3Region}}
+
+{{.Tab1}}-proxy=<URL>
+{{.Tab2}}specifies the URL of the forward proxy the clients send their requests
+{{.Tab2}}via, of the form 'http[s]://[user:password@]host:port'. The clients
+{{.Tab2}}establish a tunnel to each server with a CONNECT request, sending the
+{{.Tab2}}user and password, if any, to the proxy with the basic authentication
+{{.Tab2}}scheme. The reports show the number of files downloaded via the proxy
+{{.Tab2}}and the average time spent establishing the tunnels. The raw protocol
+{{.Tab2}}does not use proxies.
+{{.Tab2}}Default: the proxy is selected by the environment variables
+{{.Tab2}}HTTPS_PROXY and NO_PROXY of the client processes.
+
+{{.Tab1}}-resumption
+{{.Tab2}}the clients resume the TLS sessions established with the servers
+{{.Tab2}}when they open new connections, which saves a round trip per
+{{.Tab2}}connection. The servers must issue session tickets (see their
+{{.Tab2}}'-session-tickets' option). The reports show the number and the
+{{.Tab2}}average duration of the full and of the resumed handshakes.
+{{.Tab2}}Default: each new connection requires a full handshake.
+
+{{.Tab1}}-churn
+{{.Tab2}}the clients establish a new connection for each download and close it
+{{.Tab2}}once the download completes, for measuring how many new connections
+{{.Tab2}}per second the servers accept. The reports show the rate of TLS
+{{.Tab2}}handshakes, the percentiles of their duration and the average number
+{{.Tab2}}of CPU cores used by each server during the test. Use small files
+{{.Tab2}}for the handshakes to dominate the load.
+{{.Tab2}}Default: the clients reuse their connections.
+
+{{.Tab1}}-attempts=integer
+{{.Tab2}}specifies the maximum number of attempts of each download. Downloads
+{{.Tab2}}which fail because of transient errors, such as network errors or 503
+{{.Tab2}}responses, are retried after an exponentially increasing delay or the
+{{.Tab2}}delay requested by the server in its 'Retry-After' header. Interrupted
+{{.Tab2}}downloads are resumed from the last received byte.
+{{.Tab2}}Default: 1
+
+{{.Tab1}}-streams=integer
+{{.Tab2}}specifies the number of streams each file is downloaded with. The
+{{.Tab2}}file is split into as many byte ranges, downloaded concurrently over
+{{.Tab2}}separate HTTP/2 streams or, with '-http1', separate connections.
+{{.Tab2}}The ranges are downloaded unencoded.
+{{.Tab2}}Default: 1
+
+{{.Tab1}}-sample=<duration>
+{{.Tab2}}specifies the interval at which the clients sample the number of bytes
+{{.Tab2}}received during each download, e.g. '100ms'. The driver reports the
+{{.Tab2}}average throughput of the downloads over each interval since their
+{{.Tab2}}start, which reveals the effects of TCP slow start, stalls and
+{{.Tab2}}throughput oscillations.
+{{.Tab2}}Default: no sampling
+
+{{.Tab1}}-dialtimeout=<duration>
+{{.Tab2}}specifies the maximum duration of the establishment of each TCP
+{{.Tab2}}connection to the servers.
+{{.Tab2}}Default: no timeout
+
+{{.Tab1}}-tlstimeout=<duration>
+{{.Tab2}}specifies the maximum duration of each TLS handshake with the servers.
+{{.Tab2}}Default: no timeout
+
+{{.Tab1}}-firstbytetimeout=<duration>
+{{.Tab2}}specifies the maximum time the clients wait for the first byte of the
+{{.Tab2}}response to each request once the request is written.
+{{.Tab2}}Default: no timeout
+
+{{.Tab1}}-stalltimeout=<duration>
+{{.Tab2}}specifies the maximum time the clients wait for data while receiving
+{{.Tab2}}the contents of a file. Downloads which receive no data for longer are
+{{.Tab2}}considered stalled and aborted. The driver reports the number of
+{{.Tab2}}stalled downloads separately from the other timeouts. Downloads which
+{{.Tab2}}time out are retried if the '-attempts' option allows it.
+{{.Tab2}}Default: no timeout
+
+{{.Tab1}}-workerrate=<MB/sec>
+{{.Tab2}}specifies the maximum rate at which each worker of the clients
+{{.Tab2}}receives data, e.g. '125' for emulating hosts with a 1 Gb/s network
+{{.Tab2}}interface. The clients throttle the reading of the response bodies,
+{{.Tab2}}so the servers see slow consumers.
+{{.Tab2}}Default: no limit
+
+{{.Tab1}}-clientrate=<MB/sec>
+{{.Tab2}}specifies the maximum rate at which each client process receives data,
+{{.Tab2}}shared by all its workers. It may be combined with '-workerrate'.
+{{.Tab2}}Default: no limit
+
+{{.Tab1}}-sink=<mode>
+{{.Tab2}}specifies where the clients write the downloaded data. With 'discard'
+{{.Tab2}}the data is discarded. With 'buffered', 'fsync' and 'direct' each file
+{{.Tab2}}is written to the directory specified with '-sinkdir', respectively
+{{.Tab2}}via the page cache, via the page cache and flushed to storage before
+{{.Tab2}}closing it, or bypassing the page cache (O_DIRECT, Linux only). With
+{{.Tab2}}'tmpfs' the files are written to a tmpfs directory, i.e. to memory.
+{{.Tab2}}The files are removed once downloaded. The driver reports the time
+{{.Tab2}}spent writing the files separately from the time spent receiving them.
+{{.Tab2}}With 'direct' the files are written sequentially, so when combined
+{{.Tab2}}with '-streams' the clients buffer in memory the ranges received out
+{{.Tab2}}of order, which may amount to most of each file being downloaded.
+{{.Tab2}}Default: {{.DefaultSinkMode}}
+
+{{.Tab1}}-sinkdir=<directory>
+{{.Tab2}}specifies the directory on the client hosts where the downloaded files
+{{.Tab2}}are written. It must exist.
+{{.Tab2}}Default: /dev/shm for the 'tmpfs' mode, required for the other modes
+{{.Tab2}}writing files.
+
 {{.Tab1}}-help
 {{.Tab2}}print this help
 
@@ -290,5 +756,14 @@ ADDITIONAL INFORMATION:
 	tmplFields["DefaultDuration"] = defaultDuration.String()
 	tmplFields["DefaultMeanSize"] = fmt.Sprintf("%d", defaultMeanFileSize)
 	tmplFields["DefaultStdSize"] = fmt.Sprintf("%.1f", defaultStdFileSize)
+	tmplFields["DefaultChecksumMode"] = defaultChecksumMode
+	tmplFields["DefaultDigestFields"] = defaultDigestFields
+	tmplFields["DefaultTransferMode"] = defaultTransferMode
+	tmplFields["DefaultBackend"] = defaultBackend
+	tmplFields["BackendNames"] = strings.Join(backendNames(), ", ")
+	tmplFields["DefaultS3KeyTemplate"] = fileserver.DefaultS3KeyTemplate
+	tmplFields["DefaultS3Region"] = fileserver.DefaultS3Region
+	tmplFields["DefaultSinkMode"] = defaultSinkMode
+	tmplFields["ChecksumNames"] = strings.Join(fileserver.ChecksumNames(), ", ")
 	render(driverTempl, tmplFields, f)
 }
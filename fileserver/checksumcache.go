@@ -0,0 +1,60 @@
+package fileserver
+
+import (
+	"hash"
+	"sync"
+)
+
+// Maximum number of checksums kept by fileChecksums
+const checksumCacheSize = 1024
+
+// fileChecksums caches the checksums of whole files the server computes before
+// sending their contents, e.g. for each range request or each resumed
+// download, so that each file is hashed once
+var fileChecksums = &checksumCache{sums: make(map[checksumKey][]byte)}
+
+// checksumKey identifies the checksum of a file. Files of the same size made
+// of the same buffer have the same contents, whatever their identifier
+type checksumKey struct {
+	contents *byte
+	size     int64
+	algo     ChecksumAlgorithm
+}
+
+// checksumCache holds the most recently computed checksums of files. It may be
+// used concurrently
+type checksumCache struct {
+	mu    sync.Mutex
+	sums  map[checksumKey][]byte
+	order []checksumKey
+}
+
+// sum returns the checksum computed with hasher of the file of the given size
+// made of contents, computing it if not cached. The checksum may be computed
+// concurrently by several requests for the same file, so that requests for
+// different files do not wait for each other.
+func (c *checksumCache) sum(hasher hash.Hash, algo ChecksumAlgorithm, contents []byte, size int64) []byte {
+	key := checksumKey{contents: &contents[0], size: size, algo: algo}
+	c.mu.Lock()
+	sum, ok := c.sums[key]
+	c.mu.Unlock()
+	if ok {
+		return sum
+	}
+	writeContents(hasher, contents, 0, size)
+	sum = hasher.Sum(nil)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.sums[key]; ok {
+		return sum
+	}
+	if len(c.order) >= checksumCacheSize {
+		// Evict the oldest checksum
+		delete(c.sums, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.sums[key] = sum
+	c.order = append(c.order, key)
+	return sum
+}
@@ -1,6 +1,8 @@
 package fileserver
 
 import (
+	"context"
+	"crypto/md5"
 	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/tls"
@@ -8,34 +10,109 @@ import (
 	"encoding/hex"
 	"fmt"
 	"hash"
+	"hash/adler32"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
 	"golang.org/x/net/http2"
 )
 
 // Client is a client for interacting with a fileserver
 type Client struct {
 	http.Client
+
+	// HTTP fields used for negotiating the checksum with the server. The
+	// default is the custom 'checksum' query parameter
+	Digest DigestFields
+
+	// Request compressible file contents instead of random ones
+	Compressible bool
+
+	// Request deterministic file contents instead of random or compressible
+	// ones and verify each byte received against the expected contents. A
+	// download which receives corrupted bytes fails with ErrContentMismatch
+	// and its report records where the contents differ
+	Verify bool
+
+	// Value of the 'Accept-Encoding' field sent to the server (e.g. "zstd, gzip").
+	// If empty, the client only accepts unencoded response bodies
+	AcceptEncoding string
+
+	// Request the server to send the content length and the checksum as headers
+	// instead of as trailers, which may be dropped by intermediate proxies
+	UpfrontLength bool
+
+	// Bearer token sent in the 'Authorization' header of the requests, if not
+	// empty. See LoadToken
+	Token string
+
+	// URL of the forward proxy the requests are sent via, e.g. as returned by
+	// ParseProxyURL. Requests to servers using TLS go through a tunnel
+	// established with a CONNECT request. If nil, the proxy is selected from
+	// the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables. The raw
+	// protocol does not use proxies
+	Proxy *url.URL
+
+	// Policy for retrying the downloads which fail because of transient
+	// errors. The default is not to retry
+	Retry RetryPolicy
+
+	// Interval between the samples of the number of bytes received during a
+	// download, recorded in the Samples field of its report. The default is
+	// not to sample
+	SampleInterval time.Duration
+
+	// Function called with each sample recorded during a download, if not
+	// nil. It is called from a different goroutine than the download's
+	Progress func(fileID string, sample ThroughputSample)
+
+	// Maximum durations of the establishment of a TCP connection, of the TLS
+	// handshake, of the wait for the first byte of the response once the
+	// request is written and of the periods without receiving data while
+	// receiving the file contents. A download attempt which exceeds one of
+	// them fails with a DialTimeoutError, a TLSHandshakeTimeoutError, a
+	// FirstByteTimeoutError or a StallError, respectively, and may be retried.
+	// Zero means no timeout, which is the default
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	FirstByteTimeout    time.Duration
+	StallTimeout        time.Duration
+
+	// Limiter of the rate at which the response bodies are received, if not
+	// nil. It applies to all the downloads of this client, in addition to the
+	// limiter carried by the context of each download. See ContextWithRateLimiter
+	RateLimiter *RateLimiter
+
+	// Idle connections of the raw protocol, for reuse by later downloads
+	rawConns *rawPool
 }
 
 // NewClient creates a new client to interact with a fileserver.
 // Set useHttp1 to true for this client to use HTTP1 instead of HTTP2, which is the default.
 // cert and key are the filenames of the certificate and key files the client will use
-// to identify itself with the server. ca is the file name of the certificate authorities' certificates the
-// client will accept and use to authenticate the server
+// to identify itself with the server. If key is empty, the key is read from the cert file,
+// as in the combined PEM files of grid proxy certificates which contain the proxy
+// certificate, its key and the certificate chain it was issued by. ca is the file name
+// of the certificate authorities' certificates the client will accept and use to
+// authenticate the server
 func NewClient(useHttp1 bool, cert, key, ca string) (*Client, error) {
 	// Prepare client TLS configuration
-	bothZero := len(cert) == 0 && len(key) == 0
-	bothNonZero := len(cert) != 0 && len(key) != 0
-	if !bothZero && !bothNonZero {
-		return nil, fmt.Errorf("both cert and key files must be provided or both be zero length")
+	if len(cert) == 0 && len(key) != 0 {
+		return nil, fmt.Errorf("a cert file must be provided along with the key file")
+	}
+	if len(key) == 0 {
+		key = cert
 	}
 	var clientCert tls.Certificate
 	hasClientCert := false
@@ -77,13 +154,20 @@ func NewClient(useHttp1 bool, cert, key, ca string) (*Client, error) {
 		config.Certificates = []tls.Certificate{clientCert}
 	}
 	tr := &http.Transport{
-		TLSClientConfig:     config,
-		MaxIdleConnsPerHost: 100, // TODO: what would be a sensible value?
+		TLSClientConfig:        config,
+		MaxIdleConnsPerHost:    100, // TODO: what would be a sensible value?
+		GetProxyConnectHeader:  proxyConnectHeader,
+		OnProxyConnectResponse: proxyConnectResponse,
 	}
 	if !useHttp1 {
 		http2.ConfigureTransport(tr) // Required: see issue https://github.com/golang/go/issues/17051
 	}
-	return &Client{http.Client{Transport: tr}}, nil
+	c := &Client{
+		Client:   http.Client{Transport: tr, CheckRedirect: checkRedirect},
+		rawConns: &rawPool{conns: make(map[rawPoolKey][]net.Conn)},
+	}
+	tr.Proxy = c.proxy
+	return c, nil
 }
 
 type DownloadReport struct {
@@ -96,11 +180,119 @@ type DownloadReport struct {
 	// receiving the first byte of the requested file
 	TimeToFirstByte time.Duration
 
+	// Cumulated durations of the phases of the requests, as traced via
+	// net/http/httptrace: DNS resolution, TCP connection establishment, TLS
+	// handshake and time elapsed since the request was written until the first
+	// byte of the response was received. DNS, connection and handshake times
+	// are zero if the request was sent over a reused connection
+	DNSTime               time.Duration
+	ConnectTime           time.Duration
+	TLSHandshakeTime      time.Duration
+	FirstResponseByteTime time.Duration
+
+	// Number of TLS handshakes completed for the download, of those which
+	// resumed a session established previously and time spent in the latter,
+	// which is included in TLSHandshakeTime. See Client.SetSessionCache
+	TLSHandshakes           int
+	TLSResumedHandshakes    int
+	TLSResumedHandshakeTime time.Duration
+
+	// Whether the request was sent over a connection reused from a previous
+	// request and IP address of the remote end of that connection
+	ConnReused bool
+	RemoteIP   string
+
+	// Address of the forward proxy the request was sent via, if any, and time
+	// spent establishing the tunnel to the server through it. The tunnel time
+	// is zero if the request was sent over a reused connection
+	Proxy            string
+	ProxyConnectTime time.Duration
+
+	// Protocol of the response (e.g. "HTTP/2.0") and the TLS version and
+	// cipher suite negotiated for the connection (e.g. "TLS 1.3")
+	Protocol       string
+	TLSVersion     string
+	TLSCipherSuite string
+
 	// Checksum of the downloaded file, if the client has requested the server to compute it.
 	// The string has the form:
 	//    sha256:ABCDE14566
 	Checksum string
 
+	// Number of redirections followed before reaching the server which served
+	// the file and time elapsed since the request was emitted until the last
+	// redirection response was received
+	Redirects    int
+	RedirectTime time.Duration
+
+	// Network address of the server which served the file
+	Server string
+
+	// Content coding applied by the server to the response body (e.g. "gzip"), if any
+	ContentEncoding string
+
+	// Value of the 'Content-Length' header of the response or -1 if the server
+	// did not send the length of the response body up front
+	ContentLength int64
+
+	// Number of bytes of the response body as received from the network and
+	// after decoding it. They are equal if no content coding was applied
+	WireBytes int64
+	Bytes     int64
+
+	// Time spent decoding the response body
+	DecodeTime time.Duration
+
+	// Time spent waiting for the rate limiters while receiving the response
+	// body
+	ThrottleTime time.Duration
+
+	// Whether the client verified the received contents and, if so, offset of
+	// the first byte of the file which differs from the expected one or -1,
+	// number of ranges of consecutive corrupted bytes and total number of
+	// corrupted bytes
+	Verified        bool
+	FirstMismatch   int64
+	CorruptedRanges int
+	CorruptedBytes  int64
+
+	// Time spent by the server validating the bearer token of the request, as
+	// reported in its 'X-Token-Validation-Time' header
+	TokenValidationTime time.Duration
+
+	// Attempts performed for downloading the file. There are several attempts
+	// if the client retried the download after transient errors
+	Attempts []DownloadAttempt
+
+	// Reports of the streams of a parallel download, each one downloading a
+	// range of the file
+	Streams []DownloadReport
+
+	// Cumulative number of bytes of the file received at each sampling
+	// interval, if the client samples downloads. The last sample is
+	// recorded at the end of the download
+	Samples []ThroughputSample
+
+	// Error, may be nil
+	Err error
+}
+
+// DownloadAttempt records an attempt of a download
+type DownloadAttempt struct {
+	// Start and end times of the attempt
+	Start time.Time
+	End   time.Time
+
+	// Offset of the first byte of the file requested by this attempt. It is
+	// not zero if the attempt resumed an interrupted download
+	Offset int64
+
+	// Number of bytes of the file received by this attempt
+	Bytes int64
+
+	// HTTP status code of the response or zero if no response was received
+	StatusCode int
+
 	// Error, may be nil
 	Err error
 }
@@ -109,14 +301,55 @@ type DownloadReport struct {
 // chkMode and chkAlgo specify if the checksum is to be computed by the server, the client, both or none and what algorithm should
 // be used to compute that checksum
 func (c *Client) DownloadFile(serverAddr string, fileID string, size int, chkMode ChecksumMode, chkAlgo ChecksumAlgorithm, dst io.Writer) (report DownloadReport) {
-	// Verify checksum
+	return c.DownloadFileContext(context.Background(), serverAddr, fileID, size, chkMode, chkAlgo, dst)
+}
+
+// DownloadFileContext is like DownloadFile but the download is aborted, even while the
+// file contents are being received, when ctx is cancelled or its deadline expires. The
+// number of bytes received until then is recorded in the report.
+// Downloads which fail because of a transient error are retried according to the retry
+// policy of the client. An interrupted response body is resumed from the last received
+// byte, so that the file contents are written only once to dst.
+func (c *Client) DownloadFileContext(ctx context.Context, serverAddr string, fileID string, size int, chkMode ChecksumMode, chkAlgo ChecksumAlgorithm, dst io.Writer) (report DownloadReport) {
+	doRequestChecksum, digestName, err := c.checksumParams(chkMode, chkAlgo)
+	if err != nil {
+		report.Err = err
+		return
+	}
+	dl := &download{
+		url:               c.fileURL(serverAddr, fileID, size, chkAlgo, doRequestChecksum, c.Compressible),
+		end:               -1,
+		chkMode:           chkMode,
+		chkAlgo:           chkAlgo,
+		doRequestChecksum: doRequestChecksum,
+		digestName:        digestName,
+		dst:               dst,
+	}
+	c.downloadWhole(ctx, dl, fileID, &report)
+	return
+}
+
+// checksumParams verifies the checksum requested for a download and returns
+// whether the checksum is requested to the server and, if so, the name it is
+// negotiated with via digest fields
+func (c *Client) checksumParams(chkMode ChecksumMode, chkAlgo ChecksumAlgorithm) (doRequestChecksum bool, digestName string, err error) {
 	algorithm := getChecksumName(chkAlgo)
 	if chkMode != ChecksumNone && algorithm == "" {
-		report.Err = fmt.Errorf("invalid requested checksum algorithm %v", chkAlgo)
-		return
+		return false, "", fmt.Errorf("invalid requested checksum algorithm %v", chkAlgo)
+	}
+	doRequestChecksum = chkMode == ChecksumServerOnly || chkMode == ChecksumClientAndServer
+	if doRequestChecksum && c.Digest != DigestCustom {
+		if digestName = getDigestName(c.Digest, chkAlgo); digestName == "" {
+			return false, "", fmt.Errorf("checksum algorithm %q cannot be negotiated via digest fields", algorithm)
+		}
 	}
-	doRequestChecksum := chkMode == ChecksumServerOnly || chkMode == ChecksumClientAndServer
+	return doRequestChecksum, digestName, nil
+}
 
+// fileURL returns the URL of a file served at the '/file' path of the server.
+// The contents are requested compressible only if compressible is true and
+// the client does not verify them
+func (c *Client) fileURL(serverAddr string, fileID string, size int, chkAlgo ChecksumAlgorithm, doRequestChecksum bool, compressible bool) *url.URL {
 	u := &url.URL{
 		Scheme: "https",
 		Host:   serverAddr,
@@ -125,102 +358,361 @@ func (c *Client) DownloadFile(serverAddr string, fileID string, size int, chkMod
 	q := u.Query()
 	q.Set("id", fileID)
 	q.Set("size", fmt.Sprintf("%d", size))
-	if doRequestChecksum {
-		q.Set("checksum", algorithm)
+	if doRequestChecksum && c.Digest == DigestCustom {
+		q.Set("checksum", getChecksumName(chkAlgo))
+	}
+	if c.Verify {
+		q.Set("content", "deterministic")
+	} else if compressible {
+		q.Set("content", "compressible")
+	}
+	if c.UpfrontLength {
+		q.Set("length", "upfront")
 	}
 	u.RawQuery = q.Encode()
+	return u
+}
+
+// downloadWhole downloads the whole file specified by dl with a single
+// stream, sampling its progress and computing its checksum, if requested
+func (c *Client) downloadWhole(ctx context.Context, dl *download, fileID string, report *DownloadReport) {
+	if dl.chkMode == ChecksumClientOnly || dl.chkMode == ChecksumClientAndServer {
+		// The checksum covers the file contents received by all the attempts
+		dl.chksumer, _ = getChecksumByKey(dl.chkAlgo)
+	}
+	s := c.startSampling(fileID)
+	dl.dst = s.writer(dl.dst)
+	c.runDownload(ctx, dl, report)
+	report.Samples = s.stop()
+}
+
+// runDownload performs the attempts of the given download, according to the
+// retry policy of the client, and records them in the report
+func (c *Client) runDownload(ctx context.Context, dl *download, report *DownloadReport) {
+	if c.Verify {
+		// The verifier keeps track of the offset across the attempts
+		dl.verifier = newVerifier(dl.start)
+		dl.dst = io.MultiWriter(dl.verifier, dl.dst)
+	}
+	report.Start = time.Now()
+	defer func() {
+		report.End = time.Now()
+		dl.verifier.record(report)
+	}()
+	for {
+		attempt, retryable, retryAfter := c.downloadAttempt(ctx, dl, report)
+		report.Attempts = append(report.Attempts, attempt)
+		report.Err = attempt.Err
+		if attempt.Err == nil || !retryable || len(report.Attempts) >= c.Retry.MaxAttempts {
+			return
+		}
+
+		// Wait for the delay requested by the server, if any, before retrying
+		wait := retryAfter
+		if wait <= 0 {
+			wait = c.Retry.delay(len(report.Attempts))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// download holds the state of a download which persists across its attempts
+type download struct {
+	url *url.URL
+
+	// Function which adds credentials to each request, such as a signature,
+	// if any
+	sign func(req *http.Request)
+
+	// Offsets of the first and last bytes of the range of the file to
+	// download. If end is negative, the file is downloaded up to its end
+	start, end int64
+
+	chkMode           ChecksumMode
+	chkAlgo           ChecksumAlgorithm
+	doRequestChecksum bool
+	digestName        string
+	dst               io.Writer
+
+	// Checksum of the file contents computed by the client, if any
+	chksumer hash.Hash
+
+	// Verifier of the file contents, if the client verifies them
+	verifier *verifier
+
+	// Whether the checksum covers the encoded response body instead of the
+	// file contents, in which case an interrupted download cannot be resumed
+	wireHashed bool
+}
+
+// downloadAttempt performs an attempt of the given download and updates the
+// report accordingly. The attempt resumes the download from the last byte
+// received by the previous attempts, if any. It returns the attempt, whether
+// it failed because of a transient error and the delay the server requested
+// to wait before retrying, if any.
+func (c *Client) downloadAttempt(ctx context.Context, dl *download, report *DownloadReport) (attempt DownloadAttempt, retryable bool, retryAfter time.Duration) {
+	offset := dl.start + report.Bytes
+	ranged := offset > 0 || dl.end >= 0
+	attempt.Offset = offset
 	req := &http.Request{
 		Method: http.MethodGet,
-		URL:    u,
+		URL:    dl.url,
+		Header: make(http.Header),
 	}
-	report.Start = time.Now()
+	if dl.doRequestChecksum {
+		switch c.Digest {
+		case DigestRepr:
+			// The only algorithm requested is the one of the download, as the
+			// checksum computed by the client must use the same
+			req.Header.Set("Want-Repr-Digest", dl.digestName+"=10")
+		case DigestLegacy:
+			req.Header.Set("Want-Digest", dl.digestName)
+		}
+	}
+	// Setting this field disables the transparent decompression performed
+	// by the transport, so we can measure the cost of decoding the body.
+	// Ranges of the file are requested unencoded
+	if ranged {
+		last := ""
+		if dl.end >= 0 {
+			last = strconv.FormatInt(dl.end, 10)
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%s", offset, last))
+		req.Header.Set("Accept-Encoding", "identity")
+	} else if len(c.AcceptEncoding) > 0 {
+		req.Header.Set("Accept-Encoding", c.AcceptEncoding)
+	} else {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	c.setAuthorization(req)
+	if dl.sign != nil {
+		dl.sign(req)
+	}
+	trace := &redirectTrace{}
+	phases := &phaseTrace{}
+	reqCtx, watchdog := c.newWatchdog(ctx)
+	defer watchdog.stop()
+	reqCtx = httptrace.WithClientTrace(reqCtx, phases.clientTrace())
+	reqCtx = context.WithValue(reqCtx, phaseTraceKey{}, phases)
+	req = req.WithContext(context.WithValue(reqCtx, redirectTraceKey{}, trace))
+	attempt.Start = time.Now()
+	defer func() {
+		attempt.End = time.Now()
+		if timeout := context.Cause(reqCtx); attempt.Err != nil && ctx.Err() == nil && timeout != nil && timeout != context.Canceled {
+			// The attempt was aborted because one of its phases timed out
+			attempt.Err = timeout
+		}
+	}()
 	resp, err := c.Do(req)
-	report.TimeToFirstByte = time.Since(report.Start)
+	phases.record(report, resp)
+	if u, err := c.proxy(req); err == nil && u != nil {
+		report.Proxy = u.Host
+	} else {
+		report.Proxy = ""
+	}
+	if len(report.Attempts) == 0 {
+		report.TimeToFirstByte = time.Since(attempt.Start)
+	}
+	if trace.hops > 0 {
+		report.Redirects += trace.hops
+		report.RedirectTime += trace.last.Sub(attempt.Start)
+	}
 	if err != nil {
-		report.Err = err
-		return
+		attempt.Err = transportError(err)
+		return attempt, ctx.Err() == nil, 0
 	}
-
-	// Consume remaining response body
+	attempt.StatusCode = resp.StatusCode
+	report.Server = resp.Request.URL.Host
+	report.TokenValidationTime = tokenValidationTime(resp)
+
+	// Consume remaining response body. The body is read through the watchdog,
+	// so that a server which stops sending it cannot block the attempt, and
+	// then through the rate limiters, if any, so that waiting for them is not
+	// taken for a stall
+	body := c.limitReader(ctx, watchdog.body(resp.Body, report.WireBytes))
 	defer func() {
-		io.Copy(ioutil.Discard, resp.Body)
+		io.Copy(ioutil.Discard, body)
 		resp.Body.Close()
+		if lr, ok := body.(*limitedReader); ok {
+			report.ThrottleTime += lr.waited
+		}
 	}()
 
-	// In case of HTTP status not OK, consume response body which may contain the error message
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		report.Err = fmt.Errorf("error downloading file: %q", string(body))
-		return
+	// A resumed download or the download of a range requires the server to
+	// send the requested range
+	if ranged && resp.StatusCode == http.StatusOK {
+		attempt.Err = fmt.Errorf("cannot download range: server does not support ranges")
+		return attempt, false, 0
+	}
+	if ranged && resp.StatusCode == http.StatusPartialContent {
+		if cr := resp.Header.Get("Content-Range"); !strings.HasPrefix(cr, fmt.Sprintf("bytes %d-", offset)) {
+			attempt.Err = fmt.Errorf("cannot download range: unexpected 'Content-Range' value %q", cr)
+			return attempt, false, 0
+		}
+	} else if resp.StatusCode != http.StatusOK {
+		// In case of HTTP status not OK, consume response body which may contain the error message
+		msg, _ := ioutil.ReadAll(body)
+		attempt.Err = &HTTPStatusError{Code: resp.StatusCode, Message: string(msg)}
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return attempt, true, parseRetryAfter(resp.Header.Get("Retry-After"))
+		case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+			return attempt, true, 0
+		}
+		return attempt, false, 0
 	}
 
-	// We are ready to receive the file contents. Do we need to compute the checksum
-	// of the response's body?
-	src := io.Reader(resp.Body)
-	var chksumer hash.Hash
-	if chkMode == ChecksumClientOnly {
-		// Compute the checksum. Don't check against server's (if any)
-		chksumer, _ = getChecksumByKey(chkAlgo)
-		src = io.TeeReader(src, chksumer)
-	} else if chkMode == ChecksumClientAndServer {
-		// Compute the checksum and check against server's
+	// We are ready to receive the file contents. Do we need to check the
+	// checksum of the response's body against the server's?
+	wire := &countingReader{r: body}
+	src := io.Reader(wire)
+	chksumer := dl.chksumer
+	if dl.chkMode == ChecksumClientAndServer && c.Digest == DigestCustom {
 		serverAlgo := strings.ToLower(resp.Header.Get("X-Checksum-Algorithm"))
-		if algorithm != serverAlgo {
-			report.Err = fmt.Errorf("unexpected server algorithm %q", serverAlgo)
-			return
+		if algorithm := getChecksumName(dl.chkAlgo); algorithm != serverAlgo {
+			attempt.Err = fmt.Errorf("unexpected server algorithm %q", serverAlgo)
+			return attempt, false, 0
+		}
+	}
+
+	// Decode the response body, if the server applied a content coding. The
+	// checksum sent via 'Repr-Digest' covers the encoded body
+	report.ContentEncoding = strings.ToLower(resp.Header.Get("Content-Encoding"))
+	report.ContentLength = resp.ContentLength
+	var decoded *countingReader
+	isWireHashed := false
+	if report.ContentEncoding != "" && report.ContentEncoding != "identity" {
+		if chksumer != nil && c.Digest == DigestRepr {
+			src = io.TeeReader(src, chksumer)
+			isWireHashed, dl.wireHashed = true, true
+		}
+		decodeStart := time.Now()
+		decoder, err := newDecoder(report.ContentEncoding, src)
+		if err != nil {
+			attempt.Err = fmt.Errorf("error decoding response body: %s", err)
+			return attempt, false, 0
 		}
-		chksumer, _ = getChecksumByKey(chkAlgo)
+		defer decoder.Close()
+		decoded = &countingReader{r: decoder, elapsed: time.Since(decodeStart)}
+		src = decoded
+	}
+	if chksumer != nil && !isWireHashed {
 		src = io.TeeReader(src, chksumer)
 	}
 
 	// Receive the response body
-	received, err := io.Copy(dst, src)
-	report.End = time.Now()
+	received, err := io.Copy(dl.dst, src)
+	attempt.Bytes = received
+	report.WireBytes += wire.count
+	report.Bytes += received
+	if decoded != nil {
+		report.DecodeTime += decoded.elapsed - wire.elapsed
+	}
+	if err != nil {
+		// The download can be resumed from the last received byte, unless the
+		// checksum covers the encoded body
+		attempt.Err = transportError(fmt.Errorf("error receiving file contents after %d bytes: %w", report.Bytes, err))
+		return attempt, ctx.Err() == nil && !dl.wireHashed, 0
+	}
 	clientCheckSum := ""
 	if chksumer != nil {
 		clientCheckSum = strings.ToLower(hex.EncodeToString(chksumer.Sum(nil)))
 	}
 
-	// Check that the value of 'X-Content-Length' trailer and actual length of response body match
+	// Check that the length of the response body matches the value of the
+	// 'Content-Length' header, which accounts for the bytes received from the
+	// network, and/or the value of the 'X-Content-Length' trailer, which accounts
+	// for the decoded bytes. At least one of them must be present
 	clength := resp.Trailer.Get("X-Content-Length")
-	if len(clength) == 0 {
-		report.Err = fmt.Errorf("missing 'X-Content-Length' trailer")
-		return
+	if resp.ContentLength < 0 && len(clength) == 0 {
+		attempt.Err = fmt.Errorf("%w: missing both 'Content-Length' header and 'X-Content-Length' trailer", ErrMissingTrailer)
+		return attempt, false, 0
 	}
-	bodyLength, _ := strconv.ParseUint(clength, 10, 64)
-	if int64(bodyLength) != received {
-		report.Err = fmt.Errorf("response body length %d does not match 'X-Content-Length' value %d", bodyLength, received)
-		return
+	if resp.ContentLength >= 0 && resp.ContentLength != wire.count {
+		attempt.Err = fmt.Errorf("%w: response body length %d does not match 'Content-Length' value %d", ErrLengthMismatch, wire.count, resp.ContentLength)
+		return attempt, false, 0
+	}
+	if len(clength) > 0 {
+		bodyLength, _ := strconv.ParseUint(clength, 10, 64)
+		if int64(bodyLength) != received {
+			attempt.Err = fmt.Errorf("%w: response body length %d does not match 'X-Content-Length' value %d", ErrLengthMismatch, received, bodyLength)
+			return attempt, false, 0
+		}
+	}
+
+	// Check the received contents match the expected ones, if verified
+	if v := dl.verifier; v != nil && v.corruptedRanges > 0 {
+		attempt.Err = fmt.Errorf("%w: first mismatch at offset %d, %d corrupted bytes in %d ranges", ErrContentMismatch, v.firstMismatch, v.corruptedBytes, v.corruptedRanges)
+		return attempt, false, 0
 	}
 
-	// Check the received checksum and the computed one actually match
+	// Check the received checksum and the computed one actually match. The
+	// server sends the checksum either as a trailer or as a header
 	serverChecksum := ""
-	if chkMode == ChecksumClientAndServer {
-		serverChecksum = strings.ToLower(resp.Trailer.Get("X-Checksum-Value"))
+	if dl.chkMode == ChecksumServerOnly || dl.chkMode == ChecksumClientAndServer {
+		field, digestErr := checksumFieldName(c.Digest), error(nil)
+		values := resp.Trailer[field]
+		if len(values) == 0 {
+			values = resp.Header[field]
+		}
+		switch c.Digest {
+		case DigestRepr, DigestLegacy:
+			serverChecksum, digestErr = parseDigest(c.Digest, dl.chkAlgo, values)
+		default:
+			if len(values) > 0 {
+				serverChecksum = strings.ToLower(values[0])
+			}
+		}
+		if digestErr != nil {
+			attempt.Err = digestErr
+			return attempt, false, 0
+		}
 		if len(serverChecksum) == 0 {
-			report.Err = fmt.Errorf("missing 'X-Checksum-Value' trailer")
-			return
+			attempt.Err = fmt.Errorf("%w: missing '%s' trailer or header", ErrMissingTrailer, field)
+			return attempt, false, 0
 		}
-		if clientCheckSum != serverChecksum {
-			report.Err = fmt.Errorf("computed checksum (%s) and received checksum (%s) do not match", clientCheckSum, serverChecksum)
-			return
+		if dl.chkMode == ChecksumClientAndServer && clientCheckSum != serverChecksum {
+			attempt.Err = fmt.Errorf("%w: computed checksum (%s) and received checksum (%s) do not match", ErrChecksumMismatch, clientCheckSum, serverChecksum)
+			return attempt, false, 0
 		}
 	}
 
 	// Add the checksum to the download report
-	if chkMode != ChecksumNone {
+	if dl.chkMode != ChecksumNone {
+		algorithm := getChecksumName(dl.chkAlgo)
 		if serverChecksum != "" {
 			report.Checksum = fmt.Sprintf("%s:%s", algorithm, serverChecksum)
 		} else {
 			report.Checksum = fmt.Sprintf("%s:%s", algorithm, clientCheckSum)
 		}
 	}
-	return
+	return attempt, false, 0
+}
+
+// LimitConnections limits the number of TCP connections this client opens to
+// each server to n, including those being dialed. Requests wait for a
+// connection to become available once the limit is reached. Zero means no limit.
+func (c *Client) LimitConnections(n int) {
+	c.Client.Transport.(*http.Transport).MaxConnsPerHost = n
+}
+
+// DisableKeepAlives makes this client establish a new connection for each
+// request, including those of the raw protocol, and close it once the
+// response is received. It is meant for measuring the rate at which servers
+// accept new connections.
+func (c *Client) DisableKeepAlives() {
+	c.Client.Transport.(*http.Transport).DisableKeepAlives = true
 }
 
-// CloseIdleConnections closes idle TCP connections in use by this client
+// CloseIdleConnections closes idle TCP connections in use by this client,
+// including those of the raw protocol
 func (c *Client) CloseIdleConnections() {
 	c.Client.Transport.(*http.Transport).CloseIdleConnections()
+	c.rawConns.closeIdle()
 }
 
 type ChecksumAlgorithm uint
@@ -229,6 +721,11 @@ const (
 	NONE ChecksumAlgorithm = iota
 	SHA256
 	SHA512
+	ADLER32
+	CRC32C
+	MD5
+	BLAKE2B
+	XXHASH
 )
 
 type ChecksumMode int
@@ -254,13 +751,52 @@ type checksumSpec struct {
 }
 
 var (
+	// Table used for computing CRC-32C checksums
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
 	// Map of supported checksum algorithms
 	checksumMap = map[ChecksumAlgorithm]checksumSpec{
-		SHA256: {"sha256", sha256.New},
-		SHA512: {"sha512", sha512.New},
+		SHA256:  {"sha256", sha256.New},
+		SHA512:  {"sha512", sha512.New},
+		ADLER32: {"adler32", func() hash.Hash { return adler32.New() }},
+		CRC32C:  {"crc32c", func() hash.Hash { return crc32.New(castagnoliTable) }},
+		MD5:     {"md5", md5.New},
+		BLAKE2B: {"blake2b", newBlake2b},
+		XXHASH:  {"xxhash", func() hash.Hash { return xxhash.New() }},
 	}
 )
 
+// newBlake2b returns a new unkeyed BLAKE2b-512 hash
+func newBlake2b() hash.Hash {
+	// blake2b.New512 only fails if the provided key is too long
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+// ChecksumAlgorithmByName returns the checksum algorithm associated to the given
+// name (e.g. "adler32"). An error is returned if there is no such algorithm
+func ChecksumAlgorithmByName(name string) (ChecksumAlgorithm, error) {
+	name = strings.ToLower(name)
+	for k, v := range checksumMap {
+		if v.name == name {
+			return k, nil
+		}
+	}
+	return NONE, fmt.Errorf("unknown checksum algorithm %q", name)
+}
+
+// ChecksumNames returns the names of the supported checksum algorithms, in the
+// order of their declaration
+func ChecksumNames() []string {
+	names := make([]string, 0, len(checksumMap))
+	for k := SHA256; k <= XXHASH; k++ {
+		if s, ok := checksumMap[k]; ok {
+			names = append(names, s.name)
+		}
+	}
+	return names
+}
+
 // getChecksumByName returns a hash function associated to the given name, if any.
 // An error is returned if there is no function associated to that name
 func getChecksumByName(name string) (hash.Hash, error) {
@@ -270,7 +806,7 @@ func getChecksumByName(name string) (hash.Hash, error) {
 			return v.hashFunc(), nil
 		}
 	}
-	return nil, fmt.Errorf("unkown checksum algorithm %q", name)
+	return nil, fmt.Errorf("unknown checksum algorithm %q", name)
 }
 
 // getChecksumByKey returns a hash function associated to the given algorithm key, if any.
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package fileserver
+
+import "time"
+
+// processCPUTime returns zero, since the CPU time consumed by the process is
+// not available on this platform
+func processCPUTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package fileserver
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUTime returns the CPU time consumed by this process in user and
+// system mode
+func processCPUTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
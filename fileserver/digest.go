@@ -0,0 +1,235 @@
+package fileserver
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DigestFields specifies the HTTP fields the client and the server use for
+// negotiating the checksum of the contents of a file and for sending its value
+type DigestFields int
+
+const (
+	// Custom fields: the checksum algorithm is requested via the 'checksum'
+	// query parameter, acknowledged by the server in the 'X-Checksum-Algorithm'
+	// header and its hex-encoded value is sent in the 'X-Checksum-Value' trailer
+	DigestCustom DigestFields = iota
+
+	// RFC 9530 fields: the algorithm is requested via the 'Want-Repr-Digest'
+	// header and its base64-encoded value is sent in the 'Repr-Digest' trailer
+	DigestRepr
+
+	// RFC 3230 fields: the algorithm is requested via the 'Want-Digest'
+	// header and its value is sent in the 'Digest' trailer
+	DigestLegacy
+)
+
+type digestSpec struct {
+	// Name of the algorithm in the 'Want-Repr-Digest' and 'Repr-Digest' fields
+	reprName string
+
+	// Name of the algorithm in the 'Want-Digest' and 'Digest' fields
+	legacyName string
+
+	// Whether the value in the 'Digest' field is hex-encoded instead of
+	// base64-encoded
+	legacyHex bool
+}
+
+var (
+	// Map of checksum algorithms which can be negotiated via the standard
+	// digest fields. The names are the ones registered in the IANA
+	// "Hash Algorithms for HTTP Digest Fields" registry
+	digestMap = map[ChecksumAlgorithm]digestSpec{
+		SHA256:  {"sha-256", "SHA-256", false},
+		SHA512:  {"sha-512", "SHA-512", false},
+		MD5:     {"md5", "MD5", false},
+		ADLER32: {"adler", "ADLER32", true},
+		CRC32C:  {"crc32c", "CRC32c", true},
+	}
+)
+
+// digestPreference is a checksum algorithm requested by a client together with
+// its preference (higher is preferred)
+type digestPreference struct {
+	algo   ChecksumAlgorithm
+	weight float64
+}
+
+// getDigestAlgorithm returns the checksum algorithm associated to the given
+// name of the digest field
+func getDigestAlgorithm(field DigestFields, name string) (ChecksumAlgorithm, bool) {
+	name = strings.ToLower(name)
+	for k, v := range digestMap {
+		if field == DigestRepr && v.reprName == name {
+			return k, true
+		}
+		if field == DigestLegacy && strings.ToLower(v.legacyName) == name {
+			return k, true
+		}
+	}
+	return NONE, false
+}
+
+// getDigestName returns the name of the checksum algorithm as used in the given
+// digest field. The empty string is returned if the algorithm cannot be
+// negotiated via that field
+func getDigestName(field DigestFields, algo ChecksumAlgorithm) string {
+	s, ok := digestMap[algo]
+	if !ok {
+		return ""
+	}
+	switch field {
+	case DigestRepr:
+		return s.reprName
+	case DigestLegacy:
+		return s.legacyName
+	}
+	return ""
+}
+
+// parseWantReprDigest parses the value of a 'Want-Repr-Digest' field, which is
+// a structured dictionary of the form:
+//
+//	sha-512=3, sha-256=10, unixsum=0
+//
+// where each preference is an integer in the range 0 to 10 and 0 means
+// "not acceptable". Unsupported algorithms are ignored.
+func parseWantReprDigest(values []string) []digestPreference {
+	var prefs []digestPreference
+	for _, member := range splitFieldList(values) {
+		// Ignore member parameters, if any
+		member = strings.TrimSpace(strings.SplitN(member, ";", 2)[0])
+		kv := strings.SplitN(member, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || weight <= 0 || weight > 10 {
+			continue
+		}
+		if algo, ok := getDigestAlgorithm(DigestRepr, strings.TrimSpace(kv[0])); ok {
+			prefs = append(prefs, digestPreference{algo, float64(weight)})
+		}
+	}
+	return prefs
+}
+
+// parseWantDigest parses the value of a 'Want-Digest' field, which is of the
+// form:
+//
+//	SHA-256;q=0.3, MD5;q=1, ADLER32
+//
+// where the absence of a quality value means a quality of 1 and a quality of 0
+// means "not acceptable". Unsupported algorithms are ignored.
+func parseWantDigest(values []string) []digestPreference {
+	var prefs []digestPreference
+	for _, member := range splitFieldList(values) {
+		parts := strings.Split(member, ";")
+		weight := 1.0
+		for _, p := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				q, err := strconv.ParseFloat(kv[1], 64)
+				if err != nil {
+					q = 0
+				}
+				weight = q
+			}
+		}
+		if weight <= 0 || weight > 1 {
+			continue
+		}
+		if algo, ok := getDigestAlgorithm(DigestLegacy, strings.TrimSpace(parts[0])); ok {
+			prefs = append(prefs, digestPreference{algo, weight})
+		}
+	}
+	return prefs
+}
+
+// selectDigest returns the preferred checksum algorithm among the given
+// preferences. In case of ties, the algorithm which appears first is selected.
+// NONE is returned if there is no acceptable algorithm.
+func selectDigest(prefs []digestPreference) ChecksumAlgorithm {
+	selected, best := NONE, 0.0
+	for _, p := range prefs {
+		if p.weight > best {
+			selected, best = p.algo, p.weight
+		}
+	}
+	return selected
+}
+
+// formatDigest formats the value of the 'Repr-Digest' or 'Digest' field for
+// the given algorithm and raw digest
+func formatDigest(field DigestFields, algo ChecksumAlgorithm, sum []byte) string {
+	s := digestMap[algo]
+	switch field {
+	case DigestRepr:
+		return fmt.Sprintf("%s=:%s:", s.reprName, base64.StdEncoding.EncodeToString(sum))
+	case DigestLegacy:
+		if s.legacyHex {
+			return fmt.Sprintf("%s=%s", s.legacyName, hex.EncodeToString(sum))
+		}
+		return fmt.Sprintf("%s=%s", s.legacyName, base64.StdEncoding.EncodeToString(sum))
+	}
+	return ""
+}
+
+// parseDigest extracts from the value of a 'Repr-Digest' or 'Digest' field the
+// digest computed with the given algorithm. The digest is returned as a
+// lowercase hex-encoded string.
+func parseDigest(field DigestFields, algo ChecksumAlgorithm, values []string) (string, error) {
+	s, ok := digestMap[algo]
+	if !ok {
+		return "", fmt.Errorf("checksum algorithm %q cannot be negotiated via digest fields", getChecksumName(algo))
+	}
+	for _, member := range splitFieldList(values) {
+		kv := strings.SplitN(member, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		var sum []byte
+		var err error
+		switch {
+		case field == DigestRepr && strings.ToLower(name) == s.reprName:
+			// Value is a structured byte sequence, i.e. base64 between colons
+			value = strings.TrimSpace(strings.SplitN(value, ";", 2)[0])
+			if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+				return "", fmt.Errorf("invalid 'Repr-Digest' value %q", value)
+			}
+			sum, err = base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		case field == DigestLegacy && strings.EqualFold(name, s.legacyName):
+			if s.legacyHex {
+				sum, err = hex.DecodeString(value)
+			} else {
+				sum, err = base64.StdEncoding.DecodeString(value)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("invalid digest value %q [%s]", value, err)
+		}
+		return hex.EncodeToString(sum), nil
+	}
+	return "", nil
+}
+
+// splitFieldList splits the values of a list-based HTTP field into its
+// non-empty members
+func splitFieldList(values []string) []string {
+	var members []string
+	for _, v := range values {
+		for _, m := range strings.Split(v, ",") {
+			if m = strings.TrimSpace(m); len(m) > 0 {
+				members = append(members, m)
+			}
+		}
+	}
+	return members
+}
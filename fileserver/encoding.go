@@ -0,0 +1,140 @@
+package fileserver
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Names of the supported content codings, in order of server preference
+	EncodingZstd = "zstd"
+	EncodingGzip = "gzip"
+)
+
+var (
+	// Supported content codings, in order of server preference
+	contentEncodings = []string{EncodingZstd, EncodingGzip}
+)
+
+// makeCompressibleBuffer returns a buffer of the given size filled with text-like
+// contents, made of words randomly picked from a small vocabulary. The contents
+// are highly compressible, which is not the case of contentsBuffer.
+func makeCompressibleBuffer(size int) []byte {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	vocabulary := make([]string, 512)
+	for i := range vocabulary {
+		word := make([]byte, 2+rand.Intn(9))
+		for j := range word {
+			word[j] = letters[rand.Intn(len(letters))]
+		}
+		vocabulary[i] = string(word)
+	}
+	b := make([]byte, 0, size+16)
+	for len(b) < size {
+		b = append(b, vocabulary[rand.Intn(len(vocabulary))]...)
+		if rand.Intn(12) == 0 {
+			b = append(b, '\n')
+		} else {
+			b = append(b, ' ')
+		}
+	}
+	return b[:size]
+}
+
+// negotiateEncoding selects the content coding to apply to the response body
+// according to the 'Accept-Encoding' field of the request. It returns the empty
+// string if no supported coding is acceptable to the client, in which case the
+// body is sent unencoded.
+func negotiateEncoding(values []string) string {
+	selected, best := "", 0.0
+	for _, member := range splitFieldList(values) {
+		parts := strings.Split(member, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		weight := 1.0
+		for _, p := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				q, err := strconv.ParseFloat(kv[1], 64)
+				if err != nil {
+					q = 0
+				}
+				weight = q
+			}
+		}
+		for _, e := range contentEncodings {
+			if coding != e || weight <= 0 {
+				continue
+			}
+			// Break ties in favour of the server preference
+			if weight > best || (weight == best && preferredEncoding(e, selected)) {
+				selected, best = e, weight
+			}
+		}
+	}
+	return selected
+}
+
+// preferredEncoding returns true if the server prefers content coding a over b
+func preferredEncoding(a, b string) bool {
+	for _, e := range contentEncodings {
+		if e == a {
+			return true
+		}
+		if e == b {
+			return false
+		}
+	}
+	return false
+}
+
+// newEncoder returns a writer which applies the specified content coding to
+// the data written to it and writes the result to w. The returned writer must
+// be closed for flushing the encoded data.
+func newEncoder(coding string, w io.Writer) (io.WriteCloser, error) {
+	switch coding {
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	case EncodingZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported content coding %q", coding)
+}
+
+// newDecoder returns a reader which decodes the data read from r according to
+// the specified content coding
+func newDecoder(coding string, r io.Reader) (io.ReadCloser, error) {
+	switch coding {
+	case EncodingGzip:
+		return gzip.NewReader(r)
+	case EncodingZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported content coding %q", coding)
+}
+
+// countingReader counts the bytes read from the underlying reader and the time
+// spent reading them
+type countingReader struct {
+	r       io.Reader
+	count   int64
+	elapsed time.Duration
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := c.r.Read(p)
+	c.elapsed += time.Since(start)
+	c.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,49 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrChecksumMismatch is the error of a transfer whose checksum computed
+	// by the client does not match the one sent by the server
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrLengthMismatch is the error of a transfer whose number of bytes
+	// received does not match the length announced by the server
+	ErrLengthMismatch = errors.New("length mismatch")
+
+	// ErrContentMismatch is the error of a transfer whose contents differ from
+	// the expected ones, as verified by the client
+	ErrContentMismatch = errors.New("content mismatch")
+
+	// ErrMissingTrailer is the error of a transfer whose response lacks the
+	// length or the checksum, expected either as a trailer or as a header
+	ErrMissingTrailer = errors.New("missing trailer")
+
+	// ErrTransport is the error of a transfer which failed because of the
+	// network connection to the server, e.g. the connection could not be
+	// established or was reset
+	ErrTransport = errors.New("transport error")
+)
+
+// HTTPStatusError is the error of a transfer whose response has an unexpected
+// status code
+type HTTPStatusError struct {
+	// Status code of the response
+	Code int
+
+	// Body of the response, which may contain an error message
+	Message string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("server responded with status %d: %q", e.Code, e.Message)
+}
+
+// transportError wraps err, returned by the transport of the client, so that it
+// matches ErrTransport
+func transportError(err error) error {
+	return fmt.Errorf("%w: %w", ErrTransport, err)
+}
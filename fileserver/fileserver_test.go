@@ -1,15 +1,57 @@
 package fileserver
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"os"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const (
-	serverAddr = "localhost:5678"
+	serverAddr        = "localhost:5678"
+	redirectorAddr    = "localhost:5679"
+	tpcServerAddr     = "localhost:5680"
+	tokenServerAddr   = "localhost:5681"
+	flakyServerAddr   = "localhost:5682"
+	stallServerAddr   = "localhost:5683"
+	mutedServerAddr   = "localhost:5684"
+	brokenServerAddr  = "localhost:5685"
+	corruptServerAddr = "localhost:5686"
+	s3ServerAddr      = "localhost:5687"
+	rawServerAddr     = "localhost:5688"
+	rawTLSServerAddr  = "localhost:5689"
+	forwardProxyAddr  = "localhost:5690"
+	resumingAddrA     = "localhost:5691"
+	resumingAddrB     = "localhost:5692"
+	noTicketsAddr     = "localhost:5693"
+	churnServerAddr   = "localhost:5694"
 )
 
 var (
@@ -62,11 +104,14 @@ func TestServer(t *testing.T) {
 
 		{http.MethodHead, "/file", http.StatusMethodNotAllowed}, // TODO: HEAD should be supported
 		{http.MethodPost, "/file", http.StatusMethodNotAllowed},
-		{http.MethodPut, "/file", http.StatusMethodNotAllowed},
+		{http.MethodPut, "/file", http.StatusBadRequest}, // PUT is supported for third-party copies
 		{http.MethodDelete, "/file", http.StatusMethodNotAllowed},
 		{http.MethodOptions, "/file", http.StatusMethodNotAllowed},
 		{http.MethodTrace, "/file", http.StatusMethodNotAllowed},
 
+		{"COPY", "/file?id=myfileid&size=1234", http.StatusMethodNotAllowed},   // Third-party copy not enabled
+		{http.MethodPut, "/file?id=myfileid&size=1234", http.StatusBadRequest}, // Empty body
+
 		{http.MethodGet, "/file", http.StatusBadRequest},
 		{http.MethodGet, "/file?id=myfileid&size=", http.StatusBadRequest},
 		{http.MethodGet, "/file?id=myfileid&size=1234&size=7890", http.StatusBadRequest},
@@ -122,6 +167,29 @@ var tests = []DownloadTestCase{
 	{"test10", 945710, ChecksumClientOnly, ChecksumAlgorithm(SHA512), false},
 	{"test11", 945710, ChecksumServerOnly, ChecksumAlgorithm(SHA512), false},
 	{"test12", 945710, ChecksumClientAndServer, ChecksumAlgorithm(SHA512), false},
+
+	{"test13", 945710, ChecksumClientAndServer, ChecksumAlgorithm(ADLER32), false},
+	{"test14", 945710, ChecksumClientAndServer, ChecksumAlgorithm(CRC32C), false},
+	{"test15", 945710, ChecksumClientAndServer, ChecksumAlgorithm(MD5), false},
+	{"test16", 945710, ChecksumClientAndServer, ChecksumAlgorithm(BLAKE2B), false},
+	{"test17", 945710, ChecksumClientAndServer, ChecksumAlgorithm(XXHASH), false},
+	{"test18", 2500000, ChecksumServerOnly, ChecksumAlgorithm(ADLER32), false},
+	{"test19", 2500000, ChecksumClientOnly, ChecksumAlgorithm(CRC32C), false},
+}
+
+func TestChecksumAlgorithmByName(t *testing.T) {
+	for _, name := range ChecksumNames() {
+		algo, err := ChecksumAlgorithmByName(name)
+		if err != nil {
+			t.Fatalf("unexpected error for checksum algorithm %q: %s", name, err)
+		}
+		if getChecksumName(algo) != name {
+			t.Fatalf("expecting checksum algorithm %q got %q", name, getChecksumName(algo))
+		}
+	}
+	if _, err := ChecksumAlgorithmByName("xxxx"); err == nil {
+		t.Fatalf("expecting error for unknown checksum algorithm")
+	}
 }
 
 func TestAnonymousDownload(t *testing.T) {
@@ -160,3 +228,1623 @@ func doDownloads(client *Client, addr string, tests []DownloadTestCase, t *testi
 		}
 	}
 }
+
+func TestDigestDownload(t *testing.T) {
+	// Setup server
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+
+	// Create client
+	client, err := NewClient(false, certPath("chasqui_client.pem"), certPath("chasqui_client.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+
+	digestTests := []DownloadTestCase{
+		{"digest1", 945710, ChecksumClientAndServer, ChecksumAlgorithm(SHA256), false},
+		{"digest2", 945710, ChecksumClientAndServer, ChecksumAlgorithm(SHA512), false},
+		{"digest3", 945710, ChecksumClientAndServer, ChecksumAlgorithm(MD5), false},
+		{"digest4", 945710, ChecksumClientAndServer, ChecksumAlgorithm(ADLER32), false},
+		{"digest5", 945710, ChecksumClientAndServer, ChecksumAlgorithm(CRC32C), false},
+		{"digest6", 945710, ChecksumServerOnly, ChecksumAlgorithm(SHA256), false},
+
+		// Algorithms not registered for digest fields cannot be negotiated
+		{"digest7", 945710, ChecksumClientAndServer, ChecksumAlgorithm(XXHASH), true},
+		{"digest8", 945710, ChecksumClientOnly, ChecksumAlgorithm(XXHASH), false},
+	}
+	for _, fields := range []DigestFields{DigestRepr, DigestLegacy} {
+		client.Digest = fields
+		doDownloads(client, fsrv.addr, digestTests, t)
+	}
+}
+
+type WantDigestTestCase struct {
+	header   string
+	value    string
+	expected string
+}
+
+func TestWantDigest(t *testing.T) {
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+	client, err := NewClient(false, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+
+	tests := []WantDigestTestCase{
+		{"Want-Repr-Digest", "sha-512=3, sha-256=10", "Repr-Digest: sha-256=:"},
+		{"Want-Repr-Digest", "sha-512=3, unixsum=10", "Repr-Digest: sha-512=:"},
+		{"Want-Repr-Digest", "sha-256=0, adler=1", "Repr-Digest: adler=:"},
+		{"Want-Repr-Digest", "unixsum=10", ""},
+		{"Want-Digest", "SHA-256;q=0.3, MD5", "Digest: MD5="},
+		{"Want-Digest", "adler32, sha-512;q=0.5", "Digest: ADLER32="},
+		{"Want-Digest", "crc32c;q=0", ""},
+	}
+	u := "https://" + fsrv.addr + "/file?id=wantdigest&size=1000"
+	for i, c := range tests {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			t.Fatalf("failed creating new request to URL %s: %s [test #%d]", u, err, i)
+		}
+		req.Header.Set(c.header, c.value)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s failed: %s [test #%d]", u, err, i)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		got := ""
+		for _, name := range []string{"Repr-Digest", "Digest"} {
+			if v := resp.Trailer.Get(name); v != "" {
+				got = name + ": " + v
+			}
+		}
+		if !strings.HasPrefix(got, c.expected) || (c.expected == "" && got != "") {
+			t.Fatalf("%s: %s expecting trailer %q got %q [test #%d]", c.header, c.value, c.expected, got, i)
+		}
+	}
+}
+
+func TestEncodedDownload(t *testing.T) {
+	// Setup server
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+
+	// Create client
+	client, err := NewClient(false, certPath("chasqui_client.pem"), certPath("chasqui_client.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	client.Compressible = true
+
+	encodingTests := []DownloadTestCase{
+		{"encoded1", 2945710, ChecksumNone, ChecksumAlgorithm(SHA256), false},
+		{"encoded2", 2945710, ChecksumClientOnly, ChecksumAlgorithm(SHA256), false},
+		{"encoded3", 2945710, ChecksumClientAndServer, ChecksumAlgorithm(ADLER32), false},
+	}
+	for _, encoding := range []string{"", EncodingGzip, EncodingZstd} {
+		client.AcceptEncoding = encoding
+		for _, fields := range []DigestFields{DigestCustom, DigestRepr, DigestLegacy} {
+			client.Digest = fields
+			for _, c := range encodingTests {
+				report := client.DownloadFile(fsrv.addr, c.fileID, c.size, c.mode, c.algorithm, ioutil.Discard)
+				if report.Err != nil {
+					t.Fatalf("unexpected error downloading file %q with encoding %q: %s", c.fileID, encoding, report.Err)
+				}
+				if report.ContentEncoding != encoding {
+					t.Fatalf("expecting content encoding %q got %q", encoding, report.ContentEncoding)
+				}
+				if report.Bytes != int64(c.size) {
+					t.Fatalf("expecting %d decoded bytes got %d", c.size, report.Bytes)
+				}
+				if encoding != "" && report.WireBytes >= report.Bytes {
+					t.Fatalf("expecting fewer wire bytes than decoded bytes: got %d wire bytes for %d bytes", report.WireBytes, report.Bytes)
+				}
+			}
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                       "",
+		"identity":               "",
+		"gzip":                   EncodingGzip,
+		"gzip, zstd":             EncodingZstd,
+		"gzip;q=1, zstd;q=0.5":   EncodingGzip,
+		"zstd;q=0, gzip;q=0.1":   EncodingGzip,
+		"br, deflate, zstd;q=0":  "",
+		"GZIP;q=0.8, Zstd;q=0.8": EncodingZstd,
+	}
+	for accept, expected := range tests {
+		if got := negotiateEncoding([]string{accept}); got != expected {
+			t.Fatalf("Accept-Encoding: %q expecting %q got %q", accept, expected, got)
+		}
+	}
+}
+
+func TestUpfrontLengthDownload(t *testing.T) {
+	// Setup server
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+
+	// Create client
+	client, err := NewClient(false, certPath("chasqui_client.pem"), certPath("chasqui_client.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	client.UpfrontLength = true
+
+	for _, fields := range []DigestFields{DigestCustom, DigestRepr, DigestLegacy} {
+		client.Digest = fields
+		for _, c := range tests[4:] {
+			if fields != DigestCustom && getDigestName(fields, c.algorithm) == "" {
+				continue
+			}
+			report := client.DownloadFile(fsrv.addr, c.fileID, c.size, c.mode, c.algorithm, ioutil.Discard)
+			if report.Err != nil {
+				t.Fatalf("unexpected error downloading file %q: %s", c.fileID, report.Err)
+			}
+			if report.ContentLength != int64(c.size) {
+				t.Fatalf("expecting content length %d got %d", c.size, report.ContentLength)
+			}
+		}
+	}
+
+	// Compressible contents are not encoded when the length is sent up front
+	client.Compressible, client.AcceptEncoding = true, EncodingGzip
+	report := client.DownloadFile(fsrv.addr, "upfront", 945710, ChecksumClientAndServer, SHA256, ioutil.Discard)
+	if report.Err != nil {
+		t.Fatalf("unexpected error downloading file %q: %s", "upfront", report.Err)
+	}
+	if report.ContentEncoding != "" || report.ContentLength != 945710 {
+		t.Fatalf("expecting unencoded contents of length %d got encoding %q and length %d", 945710, report.ContentEncoding, report.ContentLength)
+	}
+}
+
+func TestRedirectedDownload(t *testing.T) {
+	// Setup a file server and a redirector in front of it
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+	redir, err := NewServer(redirectorAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating a new redirector: %s", err)
+	}
+	if err := redir.RedirectTo([]string{fsrv.addr}, RedirectHash, http.StatusTemporaryRedirect); err != nil {
+		t.Fatalf("failed configuring redirector: %s", err)
+	}
+	go redir.Serve()
+	waitListening(redirectorAddr, t)
+
+	// Create client
+	client, err := NewClient(false, certPath("chasqui_client.pem"), certPath("chasqui_client.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	for _, c := range tests[4:] {
+		report := client.DownloadFile(redir.addr, c.fileID, c.size, c.mode, c.algorithm, ioutil.Discard)
+		if report.Err != nil {
+			t.Fatalf("unexpected error downloading file %q: %s", c.fileID, report.Err)
+		}
+		if report.Redirects != 1 || report.Server != fsrv.addr {
+			t.Fatalf("expecting 1 redirect to %s got %d to %s", fsrv.addr, report.Redirects, report.Server)
+		}
+		if report.RedirectTime <= 0 || report.RedirectTime > report.TimeToFirstByte {
+			t.Fatalf("unexpected redirect time %s (time to first byte %s)", report.RedirectTime, report.TimeToFirstByte)
+		}
+	}
+}
+
+func TestRedirectStrategy(t *testing.T) {
+	backends := []string{"a:1", "b:2", "c:3"}
+	r := &redirector{backends: backends, strategy: RedirectRoundRobin}
+	for i := 0; i < 2*len(backends); i++ {
+		if got := r.selectBackend("file"); got != backends[i%len(backends)] {
+			t.Fatalf("round robin: expecting backend %s got %s", backends[i%len(backends)], got)
+		}
+	}
+	r.strategy = RedirectHash
+	for _, id := range []string{"file-1", "file-2", "file-3"} {
+		if r.selectBackend(id) != r.selectBackend(id) {
+			t.Fatalf("hash: expecting the same backend for file %q", id)
+		}
+	}
+	if _, err := RedirectStrategyByName("xxxx"); err == nil {
+		t.Fatalf("expecting error for unknown redirection strategy")
+	}
+}
+
+// waitListening waits until a server accepts connections on the given address
+func waitListening(addr string, t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server at %s is not listening", addr)
+}
+
+func TestThirdPartyCopy(t *testing.T) {
+	// Setup a file server and an active server which copies files from and to it
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+	active, err := NewServer(tpcServerAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating a new Fileserver: %s", err)
+	}
+	tpcClient, err := NewClient(false, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	active.EnableThirdPartyCopy(tpcClient, 10*time.Millisecond)
+	go active.Serve()
+	waitListening(tpcServerAddr, t)
+
+	// Create client
+	client, err := NewClient(false, certPath("chasqui_client.pem"), certPath("chasqui_client.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	for _, mode := range []CopyMode{CopyPull, CopyPush} {
+		for _, size := range []int{1000, 945710, 25000000} {
+			report := client.CopyFile(active.addr, fsrv.addr, "tpc", size, mode)
+			if report.Err != nil {
+				t.Fatalf("unexpected error copying file of size %d [mode %d]: %s", size, mode, report.Err)
+			}
+			if len(report.Markers) == 0 || report.Bytes != int64(size) {
+				t.Fatalf("expecting performance markers reporting %d bytes got %d markers reporting %d bytes [mode %d]", size, len(report.Markers), report.Bytes, mode)
+			}
+		}
+	}
+
+	// Copying from a server which does not exist must fail
+	report := client.CopyFile(active.addr, "localhost:1", "tpc", 1000, CopyPull)
+	if report.Err == nil {
+		t.Fatalf("expecting error copying file from a non-existent server")
+	}
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	// Generate the issuer key and the key set file the server loads
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating key: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "chasqui")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	keySet := fmt.Sprintf(`{"keys":[{"kty":"RSA","kid":"key1","n":%q,"e":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+	keysFile := path.Join(dir, "keys.json")
+	if err := ioutil.WriteFile(keysFile, []byte(keySet), 0600); err != nil {
+		t.Fatalf("failed writing key set file: %s", err)
+	}
+
+	// Setup a server which accepts tokens
+	srv, err := NewServer(tokenServerAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating a new Fileserver: %s", err)
+	}
+	if err := srv.EnableTokens(keysFile, "https://issuer.example.org", "https://storage.example.org"); err != nil {
+		t.Fatalf("failed enabling tokens: %s", err)
+	}
+	go srv.Serve()
+	waitListening(tokenServerAddr, t)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating key: %s", err)
+	}
+	now := time.Now().Unix()
+	claims := func(scope, iss, aud string, exp int64) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   iss,
+			"sub":   "chasqui",
+			"aud":   aud,
+			"exp":   exp,
+			"scope": scope,
+		}
+	}
+	const (
+		issuer   = "https://issuer.example.org"
+		audience = "https://storage.example.org"
+	)
+	tests := []struct {
+		token  string
+		fileID string
+		ok     bool
+	}{
+		{signToken(key, "key1", claims("storage.read:/", issuer, audience, now+60), t), "file", true},
+		{signToken(key, "key1", claims("storage.read:/data", issuer, audience, now+60), t), "data/file", true},
+		{signToken(key, "key1", claims("storage.read:/data", issuer, wlcgAnyAudience, now+60), t), "data/file", true},
+		{signToken(key, "key1", claims("storage.read:/data", issuer, audience, now+60), t), "database", false},
+		{signToken(key, "key1", claims("storage.create:/", issuer, audience, now+60), t), "file", false},
+		{signToken(key, "key1", claims("storage.read:/", issuer, audience, now-60), t), "file", false},
+		{signToken(key, "key1", claims("storage.read:/", "https://other.example.org", audience, now+60), t), "file", false},
+		{signToken(key, "key1", claims("storage.read:/", issuer, "https://other.example.org", now+60), t), "file", false},
+		{signToken(key, "key2", claims("storage.read:/", issuer, audience, now+60), t), "file", false},
+		{signToken(otherKey, "key1", claims("storage.read:/", issuer, audience, now+60), t), "file", false},
+		{"not.a.token", "file", false},
+	}
+	client, err := NewClient(false, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	for i, test := range tests {
+		client.Token = test.token
+		report := client.DownloadFile(tokenServerAddr, test.fileID, 1000, ChecksumNone, NONE, ioutil.Discard)
+		if test.ok && report.Err != nil {
+			t.Errorf("test %d: unexpected error downloading file %q: %s", i, test.fileID, report.Err)
+		}
+		if !test.ok && report.Err == nil {
+			t.Errorf("test %d: expecting error downloading file %q", i, test.fileID)
+		}
+		if report.Err == nil && report.TokenValidationTime <= 0 {
+			t.Errorf("test %d: expecting token validation time to be reported", i)
+		}
+	}
+
+	// Clients without a token are authorized according to their certificate
+	client.Token = ""
+	if report := client.DownloadFile(tokenServerAddr, "file", 1000, ChecksumNone, NONE, ioutil.Discard); report.Err != nil {
+		t.Errorf("unexpected error downloading file anonymously: %s", report.Err)
+	}
+
+	// Servers which do not accept tokens reject them
+	setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+	client.Token = tests[0].token
+	if report := client.DownloadFile(serverAddr, "file", 1000, ChecksumNone, NONE, ioutil.Discard); report.Err == nil {
+		t.Errorf("expecting error presenting a token to a server which does not accept them")
+	}
+}
+
+// signToken returns a JWT token with the given claims signed with RS256
+func signToken(key *rsa.PrivateKey, kid string, claims map[string]interface{}, t *testing.T) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed encoding claims: %s", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("failed signing token: %s", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestProxyDownload(t *testing.T) {
+	// Setup server
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+
+	// Create a proxy of the client certificate and a proxy of that proxy
+	eeCert, err := tls.LoadX509KeyPair(certPath("chasqui_client.pem"), certPath("chasqui_client.key"))
+	if err != nil {
+		t.Fatalf("failed loading client certificate: %s", err)
+	}
+	ee, _ := x509.ParseCertificate(eeCert.Certificate[0])
+	proxy, proxyKey := makeProxy(ee, eeCert.PrivateKey.(crypto.Signer), ee.RawSubject, -1, time.Hour, t)
+	proxy2, proxy2Key := makeProxy(proxy, proxyKey, proxy.RawSubject, -1, time.Hour, t)
+
+	dir, err := ioutil.TempDir("", "chasqui")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	for i, chain := range [][]*x509.Certificate{{proxy, ee}, {proxy2, proxy, ee}} {
+		// Write the combined proxy file: proxy certificate, its key, the chain
+		key := proxyKey
+		if i == 1 {
+			key = proxy2Key
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatalf("failed encoding proxy key: %s", err)
+		}
+		blob := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain[0].Raw})
+		blob = append(blob, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+		for _, cert := range chain[1:] {
+			blob = append(blob, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+		proxyFile := path.Join(dir, fmt.Sprintf("proxy%d.pem", i))
+		if err := ioutil.WriteFile(proxyFile, blob, 0600); err != nil {
+			t.Fatalf("failed writing proxy file: %s", err)
+		}
+
+		// The key is read from the proxy file
+		client, err := NewClient(false, proxyFile, "", certPath("ca.pem"))
+		if err != nil {
+			t.Fatalf("failed creating new client %s", err)
+		}
+		doDownloads(client, fsrv.addr, tests, t)
+	}
+}
+
+func TestVerifyProxyChain(t *testing.T) {
+	caCerts, err := ioutil.ReadFile(certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed loading certificate authorities: %s", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caCerts)
+	eeCert, err := tls.LoadX509KeyPair(certPath("chasqui_client.pem"), certPath("chasqui_client.key"))
+	if err != nil {
+		t.Fatalf("failed loading client certificate: %s", err)
+	}
+	ee, _ := x509.ParseCertificate(eeCert.Certificate[0])
+	eeKey := eeCert.PrivateKey.(crypto.Signer)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	proxy, proxyKey := makeProxy(ee, eeKey, ee.RawSubject, -1, time.Hour, t)
+	limited, limitedKey := makeProxy(ee, eeKey, ee.RawSubject, 0, time.Hour, t)
+	belowLimited, _ := makeProxy(limited, limitedKey, limited.RawSubject, -1, time.Hour, t)
+	impersonated := *ee
+	impersonated.PublicKey = otherKey.Public()
+	forged, _ := makeProxy(&impersonated, otherKey, ee.RawSubject, -1, time.Hour, t)
+	expired, _ := makeProxy(ee, eeKey, ee.RawSubject, -1, -time.Hour, t)
+	other, _ := asn1.Marshal(pkix.Name{Organization: []string{"Other"}}.ToRDNSequence())
+	impostor, _ := makeProxy(ee, eeKey, other, -1, time.Hour, t)
+	proxy2, _ := makeProxy(proxy, proxyKey, proxy.RawSubject, -1, time.Hour, t)
+	caProxy, _ := newProxy(ee, eeKey, ee.RawSubject, -1, time.Hour, true, t)
+
+	tests := []struct {
+		chain []*x509.Certificate
+		ok    bool
+	}{
+		{[]*x509.Certificate{ee}, true},
+		{[]*x509.Certificate{proxy, ee}, true},
+		{[]*x509.Certificate{proxy2, proxy, ee}, true},
+		{[]*x509.Certificate{limited, ee}, true},
+		{[]*x509.Certificate{belowLimited, limited, ee}, false},
+		{[]*x509.Certificate{forged, ee}, false},
+		{[]*x509.Certificate{expired, ee}, false},
+		{[]*x509.Certificate{impostor, ee}, false},
+		{[]*x509.Certificate{proxy}, false},
+		{[]*x509.Certificate{proxy2, ee}, false},
+		{[]*x509.Certificate{caProxy, ee}, false},
+	}
+	for i, test := range tests {
+		err := verifyProxyChain(test.chain, roots)
+		if test.ok && err != nil {
+			t.Errorf("test %d: unexpected error verifying chain: %s", i, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("test %d: expecting error verifying chain", i)
+		}
+		if test.ok && endEntityCertificate(test.chain) != ee {
+			t.Errorf("test %d: unexpected end-entity certificate", i)
+		}
+	}
+}
+
+// makeProxy returns an RFC 3820 proxy certificate issued by issuer, whose
+// subject is the given raw subject with one more common name, and its key. The
+// proxy is valid for the given lifetime from now, or was valid until now if
+// lifetime is negative.
+func makeProxy(issuer *x509.Certificate, issuerKey crypto.Signer, subject []byte, pathLen int, lifetime time.Duration, t *testing.T) (*x509.Certificate, crypto.Signer) {
+	return newProxy(issuer, issuerKey, subject, pathLen, lifetime, false, t)
+}
+
+// newProxy is like makeProxy but the proxy certificate claims to be a
+// certification authority if isCA is true, which RFC 3820 forbids
+func newProxy(issuer *x509.Certificate, issuerKey crypto.Signer, subject []byte, pathLen int, lifetime time.Duration, isCA bool, t *testing.T) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating key: %s", err)
+	}
+	info := proxyCertInfo{PathLen: pathLen}
+	info.Policy.Language = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 21, 1} // inherit all
+	ext, err := asn1.Marshal(info)
+	if err != nil {
+		t.Fatalf("failed encoding proxy extension: %s", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	var rdns pkix.RDNSequence
+	if _, err := asn1.Unmarshal(subject, &rdns); err != nil {
+		t.Fatalf("failed decoding subject: %s", err)
+	}
+	rdns = append(rdns, pkix.RelativeDistinguishedNameSET{{Type: oidCommonName, Value: serial.String()}})
+	rawSubject, err := asn1.Marshal(rdns)
+	if err != nil {
+		t.Fatalf("failed encoding subject: %s", err)
+	}
+	notBefore, notAfter := time.Now().Add(-time.Minute), time.Now().Add(lifetime)
+	if lifetime < 0 {
+		notBefore, notAfter = time.Now().Add(2*lifetime), time.Now().Add(lifetime)
+	}
+	template := &x509.Certificate{
+		SerialNumber:    serial,
+		RawSubject:      rawSubject,
+		NotBefore:       notBefore,
+		NotAfter:        notAfter,
+		KeyUsage:        x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtraExtensions: []pkix.Extension{{Id: oidProxyCertInfo, Critical: true, Value: ext}},
+	}
+	if isCA {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatalf("failed creating proxy certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed parsing proxy certificate: %s", err)
+	}
+	return cert, key
+}
+
+func TestDownloadFileContext(t *testing.T) {
+	// Setup server
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+
+	// Create client
+	client, err := NewClient(false, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+
+	// A download cancelled before it starts receives nothing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report := client.DownloadFileContext(ctx, fsrv.addr, "ctx", 1000, ChecksumNone, NONE, ioutil.Discard)
+	if report.Err == nil || report.Bytes != 0 {
+		t.Fatalf("expecting error and no bytes received got %d bytes [%v]", report.Bytes, report.Err)
+	}
+
+	// A download whose deadline expires while the body is being received is
+	// aborted and the partial byte count is reported
+	const size = 100 * GB
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	report = client.DownloadFileContext(ctx, fsrv.addr, "ctx", int(size), ChecksumNone, NONE, ioutil.Discard)
+	if report.Err == nil {
+		t.Fatalf("expecting error downloading file after the deadline expired")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("download was not aborted at its deadline [elapsed %s]", elapsed)
+	}
+	if report.Bytes <= 0 || report.Bytes >= size {
+		t.Fatalf("expecting partial byte count got %d", report.Bytes)
+	}
+
+	// Same for uploads
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	upload := client.UploadFileContext(ctx, fsrv.addr, "ctx", int(size), newContentsReader(contentsBuffer, size))
+	if upload.Err == nil || upload.Bytes <= 0 || upload.Bytes >= size {
+		t.Fatalf("expecting error and partial byte count got %d bytes [%v]", upload.Bytes, upload.Err)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	const size = 1000
+	tests := []struct {
+		value      string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-99", 0, 99, true},
+		{"bytes=100-", 100, 999, true},
+		{"bytes=-100", 900, 999, true},
+		{"bytes=-2000", 0, 999, true},
+		{"bytes=900-2000", 900, 999, true},
+		{"bytes=1000-", 0, 0, false},
+		{"bytes=99-0", 0, 0, false},
+		{"bytes=0-9,20-29", 0, 0, false},
+		{"items=0-9", 0, 0, false},
+		{"bytes=abc", 0, 0, false},
+	}
+	for _, test := range tests {
+		start, end, err := parseRange(test.value, size)
+		if test.ok && (err != nil || start != test.start || end != test.end) {
+			t.Errorf("parseRange(%q): expecting %d-%d got %d-%d [%v]", test.value, test.start, test.end, start, end, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("parseRange(%q): expecting error", test.value)
+		}
+	}
+}
+
+// abortingWriter aborts the response after the given number of bytes of the
+// body were written
+type abortingWriter struct {
+	http.ResponseWriter
+	remain int
+}
+
+func (w *abortingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.remain {
+		w.ResponseWriter.Write(p[:w.remain])
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	}
+	w.remain -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func TestRetriedDownload(t *testing.T) {
+	// Setup a server which answers the first request of each download with a
+	// 503 response and aborts the response to the second one
+	fsrv, err := NewServer(flakyServerAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating a new Fileserver: %s", err)
+	}
+	var count int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, req *http.Request) {
+		switch atomic.AddInt32(&count, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "503 Service unavailable", http.StatusServiceUnavailable)
+		case 2:
+			fsrv.handleFile(&abortingWriter{ResponseWriter: w, remain: 300000}, req)
+		default:
+			fsrv.handleFile(w, req)
+		}
+	})
+	srv := &http.Server{Addr: flakyServerAddr, Handler: mux, TLSConfig: fsrv.tlsConfig}
+	go srv.ListenAndServeTLS("", "")
+	waitListening(flakyServerAddr, t)
+
+	client, err := NewClient(false, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	const size = 3000000
+	for _, digest := range []DigestFields{DigestCustom, DigestRepr} {
+		// Without retries the download fails
+		atomic.StoreInt32(&count, 0)
+		client.Digest, client.Retry = digest, RetryPolicy{}
+		report := client.DownloadFile(flakyServerAddr, "flaky", size, ChecksumClientAndServer, SHA256, ioutil.Discard)
+		if report.Err == nil || len(report.Attempts) != 1 {
+			t.Fatalf("expecting error after 1 attempt got %d attempts [%v]", len(report.Attempts), report.Err)
+		}
+
+		// With retries the download is resumed and the checksum of the whole
+		// file is verified
+		atomic.StoreInt32(&count, 0)
+		client.Retry = RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond}
+		report = client.DownloadFile(flakyServerAddr, "flaky", size, ChecksumClientAndServer, SHA256, ioutil.Discard)
+		if report.Err != nil {
+			t.Fatalf("unexpected error downloading file: %s", report.Err)
+		}
+		if n := len(report.Attempts); n != 3 {
+			t.Fatalf("expecting 3 attempts got %d", n)
+		}
+		if a := report.Attempts[0]; a.StatusCode != http.StatusServiceUnavailable || a.Err == nil {
+			t.Fatalf("expecting first attempt to fail with status 503 got %d", a.StatusCode)
+		}
+		interrupted, resumed := report.Attempts[1], report.Attempts[2]
+		if interrupted.Err == nil || interrupted.Bytes <= 0 || interrupted.Bytes >= size {
+			t.Fatalf("expecting second attempt to be interrupted got %d bytes [%v]", interrupted.Bytes, interrupted.Err)
+		}
+		if resumed.StatusCode != http.StatusPartialContent || resumed.Offset != interrupted.Bytes || resumed.Offset+resumed.Bytes != size {
+			t.Fatalf("expecting third attempt to resume at offset %d got status %d offset %d bytes %d", interrupted.Bytes, resumed.StatusCode, resumed.Offset, resumed.Bytes)
+		}
+		if report.Bytes != size || report.Checksum == "" {
+			t.Fatalf("expecting %d bytes and a checksum got %d bytes and checksum %q", size, report.Bytes, report.Checksum)
+		}
+	}
+
+	// Errors which are not transient are not retried
+	setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+	client.Retry = RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond}
+	report := client.DownloadFile(serverAddr, "flaky", 0, ChecksumNone, NONE, ioutil.Discard)
+	if report.Err == nil || len(report.Attempts) != 1 {
+		t.Fatalf("expecting error after 1 attempt got %d attempts [%v]", len(report.Attempts), report.Err)
+	}
+}
+
+// bufferAt is an io.WriterAt backed by a byte slice. It implements io.Writer
+// only for being passed to DownloadFileParallel
+type bufferAt []byte
+
+func (b bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	return copy(b[off:], p), nil
+}
+
+func (b bufferAt) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("sequential write to bufferAt")
+}
+
+func TestParallelDownload(t *testing.T) {
+	// Setup server
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+
+	// Create client
+	client, err := NewClient(false, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	for _, digest := range []DigestFields{DigestCustom, DigestRepr} {
+		client.Digest = digest
+		for _, size := range []int{1, 1000, 945710, 3000001} {
+			var expected bytes.Buffer
+			writeContents(&expected, contentsBuffer, 0, int64(size))
+			whole := client.DownloadFile(fsrv.addr, "parallel", size, ChecksumClientAndServer, SHA256, ioutil.Discard)
+			if whole.Err != nil {
+				t.Fatalf("unexpected error downloading file: %s", whole.Err)
+			}
+			for _, streams := range []int{2, 4, 7} {
+				// Contents reassembled in order
+				var buf bytes.Buffer
+				report := client.DownloadFileParallel(fsrv.addr, "parallel", size, streams, ChecksumClientAndServer, SHA256, &buf)
+				if report.Err != nil {
+					t.Fatalf("unexpected error downloading file of size %d with %d streams: %s", size, streams, report.Err)
+				}
+				if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+					t.Fatalf("unexpected contents of file of size %d downloaded with %d streams", size, streams)
+				}
+				if report.Checksum != whole.Checksum || report.Bytes != int64(size) {
+					t.Fatalf("expecting checksum %q and %d bytes got %q and %d bytes", whole.Checksum, size, report.Checksum, report.Bytes)
+				}
+				if n := minInt(streams, size); len(report.Streams) != n && n > 1 {
+					t.Fatalf("expecting %d stream reports got %d", n, len(report.Streams))
+				}
+				for i, st := range report.Streams {
+					// Only the first stream requests the server checksum
+					if (st.Checksum != "") != (i == 0) {
+						t.Fatalf("stream %d: unexpected server checksum %q", i, st.Checksum)
+					}
+				}
+
+				// Contents written at their offset
+				at := make(bufferAt, size)
+				report = client.DownloadFileParallel(fsrv.addr, "parallel", size, streams, ChecksumServerOnly, SHA256, at)
+				if report.Err != nil {
+					t.Fatalf("unexpected error downloading file of size %d with %d streams: %s", size, streams, report.Err)
+				}
+				if !bytes.Equal(at, expected.Bytes()) || report.Checksum != whole.Checksum {
+					t.Fatalf("unexpected contents or checksum of file of size %d downloaded with %d streams", size, streams)
+				}
+			}
+		}
+	}
+}
+
+func minInt(x, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+func TestParallelRanges(t *testing.T) {
+	// Setup server
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+
+	// Create client
+	client, err := NewClient(false, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	table := []struct {
+		size    int
+		streams int
+	}{
+		{2, 2},
+		{9, 4},
+		{10, 3},
+		{17, 16},
+		{100, 16},
+		{100, 33},
+		{1001, 7},
+	}
+	for _, test := range table {
+		// The ranges are contiguous, cover the whole file and none is empty
+		next := int64(0)
+		for i := 0; i < test.streams; i++ {
+			start, end := streamRange(int64(test.size), test.streams, i)
+			if start != next || end < start {
+				t.Fatalf("size %d with %d streams: invalid range %d-%d of stream %d", test.size, test.streams, start, end, i)
+			}
+			next = end + 1
+		}
+		if next != int64(test.size) {
+			t.Fatalf("size %d with %d streams: ranges end at %d", test.size, test.streams, next)
+		}
+
+		var expected bytes.Buffer
+		writeContents(&expected, contentsBuffer, 0, int64(test.size))
+		at := make(bufferAt, test.size)
+		report := client.DownloadFileParallel(fsrv.addr, "ranges", test.size, test.streams, ChecksumNone, SHA256, at)
+		if report.Err != nil {
+			t.Fatalf("unexpected error downloading file of size %d with %d streams: %s", test.size, test.streams, report.Err)
+		}
+		if !bytes.Equal(at, expected.Bytes()) || report.Bytes != int64(test.size) {
+			t.Fatalf("unexpected contents of file of size %d downloaded with %d streams", test.size, test.streams)
+		}
+	}
+}
+
+func TestDownloadPhases(t *testing.T) {
+	// Setup server
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+
+	// Create client
+	client, err := NewClient(true, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+
+	// The first download establishes a new connection
+	report := client.DownloadFile(fsrv.addr, "phases", 1000, ChecksumNone, NONE, ioutil.Discard)
+	if report.Err != nil {
+		t.Fatalf("error downloading file: %s", report.Err)
+	}
+	if report.ConnReused {
+		t.Fatalf("expecting new connection for first download")
+	}
+	if report.ConnectTime <= 0 || report.TLSHandshakeTime <= 0 || report.FirstResponseByteTime <= 0 {
+		t.Fatalf("expecting non-zero phase durations got connect=%s tls=%s first byte=%s", report.ConnectTime, report.TLSHandshakeTime, report.FirstResponseByteTime)
+	}
+	if report.RemoteIP != "127.0.0.1" && report.RemoteIP != "::1" {
+		t.Fatalf("unexpected remote IP %q", report.RemoteIP)
+	}
+	if report.Protocol != "HTTP/1.1" || report.TLSVersion == "" || report.TLSCipherSuite == "" {
+		t.Fatalf("unexpected protocol %q version %q cipher suite %q", report.Protocol, report.TLSVersion, report.TLSCipherSuite)
+	}
+
+	// The second one reuses it
+	report = client.DownloadFile(fsrv.addr, "phases", 1000, ChecksumNone, NONE, ioutil.Discard)
+	if report.Err != nil {
+		t.Fatalf("error downloading file: %s", report.Err)
+	}
+	if !report.ConnReused || report.ConnectTime != 0 || report.TLSHandshakeTime != 0 {
+		t.Fatalf("expecting reused connection got reused=%v connect=%s tls=%s", report.ConnReused, report.ConnectTime, report.TLSHandshakeTime)
+	}
+	client.CloseIdleConnections()
+}
+
+func TestSampledDownload(t *testing.T) {
+	// Setup server
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+
+	// Create client
+	client, err := NewClient(false, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	var progressCount int64
+	client.SampleInterval = 20 * time.Millisecond
+	client.Progress = func(fileID string, s ThroughputSample) {
+		if fileID == "sampled" {
+			atomic.AddInt64(&progressCount, 1)
+		}
+	}
+
+	// The download is long enough for several samples to be recorded
+	const size = 100 * GB
+	for _, streams := range []int{1, 3} {
+		atomic.StoreInt64(&progressCount, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		report := client.DownloadFileParallelContext(ctx, fsrv.addr, "sampled", int(size), streams, ChecksumNone, NONE, ioutil.Discard)
+		cancel()
+		if len(report.Samples) < 2 {
+			t.Fatalf("[streams=%d] expecting several samples got %d", streams, len(report.Samples))
+		}
+		if n := atomic.LoadInt64(&progressCount); n != int64(len(report.Samples)) {
+			t.Fatalf("[streams=%d] expecting %d progress calls got %d", streams, len(report.Samples), n)
+		}
+		for i := 1; i < len(report.Samples); i++ {
+			prev, s := report.Samples[i-1], report.Samples[i]
+			if s.Bytes < prev.Bytes || s.Elapsed < prev.Elapsed {
+				t.Fatalf("[streams=%d] samples are not cumulative: %+v then %+v", streams, prev, s)
+			}
+		}
+		if last := report.Samples[len(report.Samples)-1]; last.Bytes != report.Bytes {
+			t.Fatalf("[streams=%d] last sample accounts for %d bytes, expecting %d", streams, last.Bytes, report.Bytes)
+		}
+	}
+
+	// Downloads are not sampled by default
+	client.SampleInterval = 0
+	report := client.DownloadFile(fsrv.addr, "sampled", 1000, ChecksumNone, NONE, ioutil.Discard)
+	if report.Err != nil || len(report.Samples) != 0 {
+		t.Fatalf("expecting no samples got %d [%v]", len(report.Samples), report.Err)
+	}
+}
+
+func TestLimitConnections(t *testing.T) {
+	// Setup server
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+
+	// Create a HTTP/1 client limited to a single connection
+	client, err := NewClient(true, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	client.LimitConnections(1)
+	defer client.CloseIdleConnections()
+
+	// Concurrent downloads wait for the connection instead of opening new ones
+	const numDownloads = 4
+	reports := make(chan DownloadReport, numDownloads)
+	for i := 0; i < numDownloads; i++ {
+		go func() {
+			reports <- client.DownloadFile(fsrv.addr, "limit", int(10*MB), ChecksumNone, NONE, ioutil.Discard)
+		}()
+	}
+	newConns := 0
+	for i := 0; i < numDownloads; i++ {
+		report := <-reports
+		if report.Err != nil {
+			t.Fatalf("error downloading file: %s", report.Err)
+		}
+		if !report.ConnReused {
+			newConns++
+		}
+	}
+	if newConns != 1 {
+		t.Fatalf("expecting a single connection got %d", newConns)
+	}
+}
+
+func TestDownloadTimeouts(t *testing.T) {
+	// Setup a server which delays its response or stops sending the body of
+	// the response, depending on the requested file
+	fsrv, err := NewServer(stallServerAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating a new Fileserver: %s", err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Query().Get("id") {
+		case "late":
+			<-release
+		case "stall":
+			w.Header().Set("Content-Length", "1000")
+			w.Write(make([]byte, 100))
+			w.(http.Flusher).Flush()
+			<-release
+		}
+	})
+	srv := &http.Server{Addr: stallServerAddr, Handler: mux, TLSConfig: fsrv.tlsConfig}
+	go srv.ListenAndServeTLS("", "")
+	waitListening(stallServerAddr, t)
+
+	// Setup a server which accepts connections but never completes the TLS
+	// handshake
+	l, err := net.Listen("tcp", mutedServerAddr)
+	if err != nil {
+		t.Fatalf("failed listening to %s: %s", mutedServerAddr, err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client, err := NewClient(true, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	client.TLSHandshakeTimeout = 100 * time.Millisecond
+	client.FirstByteTimeout = 100 * time.Millisecond
+	client.StallTimeout = 100 * time.Millisecond
+
+	report := client.DownloadFile(mutedServerAddr, "muted", 1000, ChecksumNone, NONE, ioutil.Discard)
+	if _, ok := report.Err.(*TLSHandshakeTimeoutError); !ok {
+		t.Fatalf("expecting TLS handshake timeout got %v", report.Err)
+	}
+	report = client.DownloadFile(stallServerAddr, "late", 1000, ChecksumNone, NONE, ioutil.Discard)
+	if _, ok := report.Err.(*FirstByteTimeoutError); !ok {
+		t.Fatalf("expecting first byte timeout got %v", report.Err)
+	}
+	report = client.DownloadFile(stallServerAddr, "stall", 1000, ChecksumNone, NONE, ioutil.Discard)
+	if e, ok := report.Err.(*StallError); !ok || e.Bytes != 100 {
+		t.Fatalf("expecting stall after 100 bytes got %v", report.Err)
+	}
+
+	// Stalled downloads are retried
+	client.Retry = RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	report = client.DownloadFile(stallServerAddr, "stall", 1000, ChecksumNone, NONE, ioutil.Discard)
+	if len(report.Attempts) != 2 {
+		t.Fatalf("expecting 2 attempts got %d", len(report.Attempts))
+	}
+}
+
+func TestErrorClasses(t *testing.T) {
+	// Setup a server whose responses are broken in a different way for each
+	// requested file
+	fsrv, err := NewServer(brokenServerAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating a new Fileserver: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, req *http.Request) {
+		contents := make([]byte, 100)
+		w.Header().Set("X-Checksum-Algorithm", "sha256")
+		switch req.URL.Query().Get("id") {
+		case "status":
+			http.Error(w, "404 Not found", http.StatusNotFound)
+		case "length":
+			w.Header().Set("Trailer", "X-Content-Length")
+			w.Write(contents)
+			w.Header().Set("X-Content-Length", "1000")
+		case "trailer":
+			w.Write(contents)
+		case "checksum":
+			w.Header().Set("Trailer", "X-Content-Length, X-Checksum-Value")
+			w.Write(contents)
+			w.Header().Set("X-Content-Length", "100")
+			w.Header().Set("X-Checksum-Value", "0123")
+		}
+	})
+	srv := &http.Server{Addr: brokenServerAddr, Handler: mux, TLSConfig: fsrv.tlsConfig}
+	go srv.ListenAndServeTLS("", "")
+	waitListening(brokenServerAddr, t)
+
+	client, err := NewClient(false, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	report := client.DownloadFile(brokenServerAddr, "status", 100, ChecksumNone, NONE, ioutil.Discard)
+	var statusErr *HTTPStatusError
+	if !errors.As(report.Err, &statusErr) || statusErr.Code != http.StatusNotFound {
+		t.Fatalf("expecting status error with code 404 got %v", report.Err)
+	}
+	for fileID, expected := range map[string]error{
+		"length":   ErrLengthMismatch,
+		"trailer":  ErrMissingTrailer,
+		"checksum": ErrChecksumMismatch,
+	} {
+		report = client.DownloadFile(brokenServerAddr, fileID, 100, ChecksumClientAndServer, SHA256, ioutil.Discard)
+		if !errors.Is(report.Err, expected) {
+			t.Fatalf("[%s] expecting error %q got %v", fileID, expected, report.Err)
+		}
+	}
+
+	// A server which is not listening causes a transport error
+	report = client.DownloadFile("localhost:1", "transport", 100, ChecksumNone, NONE, ioutil.Discard)
+	if !errors.Is(report.Err, ErrTransport) {
+		t.Fatalf("expecting transport error got %v", report.Err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	// Setup server
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+
+	// Create a client limited to 10 MB/sec
+	client, err := NewClient(false, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	client.RateLimiter = NewRateLimiter(10 * float64(MB))
+	const size = 3 * MB
+	report := client.DownloadFile(fsrv.addr, "limited", int(size), ChecksumNone, NONE, ioutil.Discard)
+	if report.Err != nil {
+		t.Fatalf("error downloading file: %s", report.Err)
+	}
+	// The first 1/10th of a second worth of data is received without waiting
+	if elapsed := report.End.Sub(report.Start); elapsed < 180*time.Millisecond {
+		t.Fatalf("download of %d bytes at 10 MB/sec took only %s", size, elapsed)
+	}
+	if report.ThrottleTime <= 0 {
+		t.Fatalf("expecting non-zero throttle time")
+	}
+
+	// The limiter carried by the context applies in addition to the one of
+	// the client
+	ctx := ContextWithRateLimiter(context.Background(), NewRateLimiter(5*float64(MB)))
+	report = client.DownloadFileContext(ctx, fsrv.addr, "limited", int(size), ChecksumNone, NONE, ioutil.Discard)
+	if report.Err != nil {
+		t.Fatalf("error downloading file: %s", report.Err)
+	}
+	if elapsed := report.End.Sub(report.Start); elapsed < 450*time.Millisecond {
+		t.Fatalf("download of %d bytes at 5 MB/sec took only %s", size, elapsed)
+	}
+
+	// Neither waiting for the limiter nor writing slowly the received data is
+	// taken for a stall of the server
+	client.StallTimeout = 50 * time.Millisecond
+	client.RateLimiter = NewRateLimiter(float64(MB))
+	report = client.DownloadFile(fsrv.addr, "limited", int(MB/2), ChecksumNone, NONE, ioutil.Discard)
+	if report.Err != nil || len(report.Attempts) != 1 {
+		t.Fatalf("expecting a single successful attempt got %d attempts with error %v", len(report.Attempts), report.Err)
+	}
+	client.RateLimiter = nil
+	report = client.DownloadFile(fsrv.addr, "limited", int(MB/8), ChecksumNone, NONE, slowWriter{delay: 80 * time.Millisecond})
+	if report.Err != nil || len(report.Attempts) != 1 {
+		t.Fatalf("expecting a single successful attempt got %d attempts with error %v", len(report.Attempts), report.Err)
+	}
+}
+
+// slowWriter discards the data written to it after waiting for delay
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return len(p), nil
+}
+
+func TestContentVerification(t *testing.T) {
+	// Setup server
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+
+	// The contents received from a well-behaved server are verified, with
+	// one or several streams
+	client, err := NewClient(false, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	client.Verify = true
+	size := int(3*MB + 123)
+	for _, streams := range []int{1, 4} {
+		report := client.DownloadFileParallel(fsrv.addr, "verified", size, streams, ChecksumClientAndServer, SHA256, ioutil.Discard)
+		if report.Err != nil {
+			t.Fatalf("[%d streams] error downloading file: %s", streams, report.Err)
+		}
+		if !report.Verified || report.FirstMismatch != -1 || report.CorruptedRanges != 0 || report.CorruptedBytes != 0 {
+			t.Fatalf("[%d streams] unexpected verification results %+v", streams, report)
+		}
+	}
+
+	// Setup a server which corrupts some bytes of the deterministic contents
+	fsrv2, err := NewServer(corruptServerAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating a new Fileserver: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, req *http.Request) {
+		contents := append([]byte(nil), deterministicBuffer[:10000]...)
+		for i := 1000; i < 1010; i++ {
+			contents[i] ^= 0xff
+		}
+		contents[5000] ^= 0x01
+		w.Header().Set("Content-Length", "10000")
+		w.Write(contents)
+	})
+	srv := &http.Server{Addr: corruptServerAddr, Handler: mux, TLSConfig: fsrv2.tlsConfig}
+	go srv.ListenAndServeTLS("", "")
+	waitListening(corruptServerAddr, t)
+
+	report := client.DownloadFile(corruptServerAddr, "corrupted", 10000, ChecksumNone, NONE, ioutil.Discard)
+	if !errors.Is(report.Err, ErrContentMismatch) {
+		t.Fatalf("expecting content mismatch error got %v", report.Err)
+	}
+	if report.FirstMismatch != 1000 || report.CorruptedRanges != 2 || report.CorruptedBytes != 11 {
+		t.Fatalf("expecting first mismatch at 1000 and 11 bytes corrupted in 2 ranges got %d, %d and %d",
+			report.FirstMismatch, report.CorruptedBytes, report.CorruptedRanges)
+	}
+}
+
+func TestSigV4Signature(t *testing.T) {
+	// Example of the AWS documentation of SigV4 for a GET object request
+	req, _ := http.NewRequest(http.MethodGet, "https://examplebucket.s3.amazonaws.com/test.txt", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	req.Header.Set("X-Amz-Date", "20130524T000000Z")
+	signature := sigV4Signature(req, "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "20130524/us-east-1/s3/aws4_request",
+		[]string{"host", "range", "x-amz-content-sha256", "x-amz-date"})
+	if expected := "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41"; signature != expected {
+		t.Fatalf("expecting signature %s got %s", expected, signature)
+	}
+}
+
+func TestS3Download(t *testing.T) {
+	// Setup a server which serves S3 objects to signed requests
+	creds := S3Credentials{AccessKeyID: "chasqui", SecretAccessKey: "secret"}
+	fsrv, err := NewServer(s3ServerAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating a new Fileserver: %s", err)
+	}
+	fsrv.EnableS3(creds)
+	go fsrv.Serve()
+	waitListening(s3ServerAddr, t)
+
+	// Download objects with one or several streams and verify their contents
+	client, err := NewClient(false, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	s3 := &S3Config{Bucket: "bucket", KeyTemplate: "data/{id}-{size}", Credentials: creds}
+	client.Verify = true
+	size := int(2*MB + 17)
+	for _, streams := range []int{1, 3} {
+		report := client.DownloadObject(s3, fsrv.addr, "object", size, streams, ChecksumClientOnly, SHA256, ioutil.Discard)
+		if report.Err != nil {
+			t.Fatalf("[%d streams] error downloading object: %s", streams, report.Err)
+		}
+		if report.Bytes != int64(size) || report.CorruptedBytes != 0 {
+			t.Fatalf("[%d streams] expecting %d bytes got %d (%d corrupted)", streams, size, report.Bytes, report.CorruptedBytes)
+		}
+	}
+
+	// The servers do not compute checksums of objects
+	report := client.DownloadObject(s3, fsrv.addr, "object", 100, 1, ChecksumClientAndServer, SHA256, ioutil.Discard)
+	if report.Err == nil {
+		t.Fatalf("expecting error requesting server checksum of object")
+	}
+
+	// Objects whose size is not served via '/file' either are rejected
+	for _, size := range []int{0, int(TB + 1)} {
+		report := client.DownloadObject(s3, fsrv.addr, "object", size, 1, ChecksumNone, NONE, ioutil.Discard)
+		var statusErr *HTTPStatusError
+		if !errors.As(report.Err, &statusErr) || statusErr.Code != http.StatusBadRequest {
+			t.Fatalf("[size %d] expecting status error with code 400 got %v", size, report.Err)
+		}
+	}
+
+	// Requests which are not signed or signed with other credentials are rejected
+	for _, c := range []S3Credentials{{}, {AccessKeyID: "chasqui", SecretAccessKey: "other"}, {AccessKeyID: "other", SecretAccessKey: "secret"}} {
+		s3.Credentials = c
+		report := client.DownloadObject(s3, fsrv.addr, "object", 100, 1, ChecksumNone, NONE, ioutil.Discard)
+		var statusErr *HTTPStatusError
+		if !errors.As(report.Err, &statusErr) || statusErr.Code != http.StatusForbidden {
+			t.Fatalf("[%s] expecting status error with code 403 got %v", c.AccessKeyID, report.Err)
+		}
+	}
+
+	// Objects whose key does not specify a size do not exist
+	s3 = &S3Config{Bucket: "bucket", KeyTemplate: "{id}", Credentials: creds}
+	report = client.DownloadObject(s3, fsrv.addr, "object", 100, 1, ChecksumNone, NONE, ioutil.Discard)
+	var statusErr *HTTPStatusError
+	if !errors.As(report.Err, &statusErr) || statusErr.Code != http.StatusNotFound || !strings.Contains(statusErr.Message, "NoSuchKey") {
+		t.Fatalf("expecting NoSuchKey error got %v", report.Err)
+	}
+}
+
+func TestRawDownload(t *testing.T) {
+	// Setup a server which serves the raw protocol over TCP and over TLS
+	fsrv, err := NewServer(rawServerAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating a new Fileserver: %s", err)
+	}
+	go fsrv.ServeRaw(rawServerAddr, false)
+	go fsrv.ServeRaw(rawTLSServerAddr, true)
+	waitListening(rawServerAddr, t)
+	waitListening(rawTLSServerAddr, t)
+
+	client, err := NewClient(false, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	defer client.CloseIdleConnections()
+	size := int(3*MB + 5)
+	h := sha256.New()
+	writeContents(h, contentsBuffer, 0, int64(size))
+	expected := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	for addr, secure := range map[string]bool{rawServerAddr: false, rawTLSServerAddr: true} {
+		// The second download reuses the connection of the first one
+		for i := 0; i < 2; i++ {
+			report := client.DownloadFileRaw(addr, "raw", size, secure, ChecksumClientOnly, SHA256, ioutil.Discard)
+			if report.Err != nil {
+				t.Fatalf("[%s] error downloading file: %s", addr, report.Err)
+			}
+			if report.Bytes != int64(size) || report.Checksum != expected {
+				t.Fatalf("[%s] expecting %d bytes with checksum %s got %d bytes with checksum %s", addr, size, expected, report.Bytes, report.Checksum)
+			}
+			if report.ConnReused != (i > 0) {
+				t.Fatalf("[%s] download %d: unexpected connection reuse %t", addr, i, report.ConnReused)
+			}
+			if secure != (report.TLSVersion != "") {
+				t.Fatalf("[%s] unexpected TLS version %q", addr, report.TLSVersion)
+			}
+		}
+	}
+
+	// The server does not compute checksums
+	report := client.DownloadFileRaw(rawServerAddr, "raw", 100, false, ChecksumClientAndServer, SHA256, ioutil.Discard)
+	if report.Err == nil {
+		t.Fatalf("expecting error requesting server checksum")
+	}
+
+	// The server rejects the sizes it does not serve via HTTP either
+	for _, size := range []int{0, int(TB + 1), -1} {
+		report := client.DownloadFileRaw(rawServerAddr, "raw", size, false, ChecksumNone, NONE, ioutil.Discard)
+		var serverErr *RawServerError
+		if !errors.As(report.Err, &serverErr) || report.Bytes != 0 {
+			t.Fatalf("expecting server error downloading file of size %d got %v after %d bytes", size, report.Err, report.Bytes)
+		}
+	}
+}
+
+// connectProxy is a forward proxy which only serves CONNECT requests
+// authenticated with the basic scheme
+type connectProxy struct {
+	user, password string
+
+	// Number of tunnels established, updated atomically
+	tunnels int64
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	creds := base64.StdEncoding.EncodeToString([]byte(p.user + ":" + p.password))
+	if r.Header.Get("Proxy-Authorization") != "Basic "+creds {
+		w.Header().Set("Proxy-Authenticate", "Basic realm=\"test\"")
+		http.Error(w, "authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	server, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		server.Close()
+		return
+	}
+	atomic.AddInt64(&p.tunnels, 1)
+	go func() {
+		io.Copy(server, conn)
+		server.Close()
+	}()
+	io.Copy(conn, server)
+	conn.Close()
+}
+
+var (
+	forwardProxy     = &connectProxy{user: "chasqui", password: "s3cr3t"}
+	forwardProxyOnce sync.Once
+)
+
+// setupForwardProxy starts the forward proxy of the tests, if not yet started
+func setupForwardProxy(t *testing.T) *connectProxy {
+	forwardProxyOnce.Do(func() {
+		go http.ListenAndServe(forwardProxyAddr, forwardProxy)
+	})
+	waitListening(forwardProxyAddr, t)
+	return forwardProxy
+}
+
+func TestForwardProxyDownload(t *testing.T) {
+	// Setup server and proxy
+	fsrv := setupServer(serverAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"), t)
+	proxy := setupForwardProxy(t)
+
+	for _, useHttp1 := range []bool{true, false} {
+		client, err := NewClient(useHttp1, "", "", certPath("ca.pem"))
+		if err != nil {
+			t.Fatalf("failed creating new client %s", err)
+		}
+		if client.Proxy, err = ParseProxyURL("chasqui:s3cr3t@" + forwardProxyAddr); err != nil {
+			t.Fatalf("error parsing proxy URL: %s", err)
+		}
+		tunnels := atomic.LoadInt64(&proxy.tunnels)
+
+		// The first download establishes the tunnel, the second one reuses it
+		for i := 0; i < 2; i++ {
+			report := client.DownloadFile(fsrv.addr, "proxied", 1000, ChecksumClientOnly, SHA256, ioutil.Discard)
+			if report.Err != nil {
+				t.Fatalf("error downloading file via proxy: %s", report.Err)
+			}
+			if report.Proxy != forwardProxyAddr {
+				t.Fatalf("expecting proxy %q got %q", forwardProxyAddr, report.Proxy)
+			}
+			if (report.ProxyConnectTime > 0) != (i == 0) {
+				t.Fatalf("download %d: unexpected proxy connect time %s", i, report.ProxyConnectTime)
+			}
+		}
+		if n := atomic.LoadInt64(&proxy.tunnels) - tunnels; n != 1 {
+			t.Fatalf("expecting 1 tunnel got %d", n)
+		}
+		client.CloseIdleConnections()
+	}
+
+	// The proxy refuses clients without the right credentials
+	client, err := NewClient(true, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	if client.Proxy, err = ParseProxyURL("http://chasqui:wrong@" + forwardProxyAddr); err != nil {
+		t.Fatalf("error parsing proxy URL: %s", err)
+	}
+	report := client.DownloadFile(fsrv.addr, "proxied", 1000, ChecksumNone, NONE, ioutil.Discard)
+	var proxyErr *ProxyError
+	if !errors.As(report.Err, &proxyErr) || proxyErr.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("expecting proxy authentication error got %v", report.Err)
+	}
+
+	// Without proxy, the requests are sent directly to the server
+	client.Proxy = nil
+	report = client.DownloadFile(fsrv.addr, "direct", 1000, ChecksumNone, NONE, ioutil.Discard)
+	if report.Err != nil || report.Proxy != "" {
+		t.Fatalf("expecting direct download got proxy %q error %v", report.Proxy, report.Err)
+	}
+	client.CloseIdleConnections()
+
+	for _, invalid := range []string{"socks5://localhost:1080", "http://", "http://%zz"} {
+		if _, err := ParseProxyURL(invalid); err == nil {
+			t.Fatalf("expecting error parsing proxy URL %q", invalid)
+		}
+	}
+}
+
+func TestSessionResumption(t *testing.T) {
+	// Setup two servers sharing their session ticket keys and a server which
+	// does not issue session tickets
+	dir, err := ioutil.TempDir("", "chasqui")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	keysFile := path.Join(dir, "tickets.keys")
+	keys := strings.Repeat("ab", 32) + "\n" + strings.Repeat("cd", 32) + "\n"
+	if err := ioutil.WriteFile(keysFile, []byte(keys), 0600); err != nil {
+		t.Fatalf("failed writing session ticket keys file: %s", err)
+	}
+	ticketKeys, err := LoadSessionTicketKeys(keysFile)
+	if err != nil || len(ticketKeys) != 2 {
+		t.Fatalf("error loading session ticket keys: %d keys, %v", len(ticketKeys), err)
+	}
+	for _, addr := range []string{resumingAddrA, resumingAddrB, noTicketsAddr} {
+		fsrv, err := NewServer(addr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"))
+		if err != nil {
+			t.Fatalf("failed creating a new Fileserver: %s", err)
+		}
+		if addr == noTicketsAddr {
+			fsrv.DisableSessionTickets()
+		} else {
+			fsrv.SetSessionTicketKeys(ticketKeys)
+		}
+		go fsrv.Serve()
+		waitListening(addr, t)
+	}
+
+	client, err := NewClient(true, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	client.SetSessionCache(tls.NewLRUClientSessionCache(0))
+	cases := []struct {
+		addr    string
+		resumed int
+	}{
+		{resumingAddrA, 0},
+		{resumingAddrA, 1},
+		{resumingAddrB, 1}, // The session established with A is resumed with B
+		{noTicketsAddr, 0},
+		{noTicketsAddr, 0},
+	}
+	for i, c := range cases {
+		// Each download establishes a new connection
+		report := client.DownloadFile(c.addr, "resumed", 1000, ChecksumNone, NONE, ioutil.Discard)
+		client.CloseIdleConnections()
+		if report.Err != nil {
+			t.Fatalf("[%d] error downloading file: %s", i, report.Err)
+		}
+		if report.TLSHandshakes != 1 || report.TLSResumedHandshakes != c.resumed {
+			t.Fatalf("[%d] expecting 1 handshake with %d resumed got %d handshakes with %d resumed", i, c.resumed, report.TLSHandshakes, report.TLSResumedHandshakes)
+		}
+		if (report.TLSResumedHandshakeTime > 0) != (c.resumed > 0) || report.TLSResumedHandshakeTime > report.TLSHandshakeTime {
+			t.Fatalf("[%d] unexpected resumed handshake time %s out of %s", i, report.TLSResumedHandshakeTime, report.TLSHandshakeTime)
+		}
+	}
+
+	// Without a session cache, handshakes are never resumed
+	client.SetSessionCache(nil)
+	report := client.DownloadFile(resumingAddrA, "resumed", 1000, ChecksumNone, NONE, ioutil.Discard)
+	client.CloseIdleConnections()
+	if report.Err != nil || report.TLSHandshakes != 1 || report.TLSResumedHandshakes != 0 {
+		t.Fatalf("expecting full handshake got %d handshakes with %d resumed, error %v", report.TLSHandshakes, report.TLSResumedHandshakes, report.Err)
+	}
+
+	if err := ioutil.WriteFile(keysFile, []byte("abcd\n"), 0600); err != nil {
+		t.Fatalf("failed writing session ticket keys file: %s", err)
+	}
+	if _, err := LoadSessionTicketKeys(keysFile); err == nil {
+		t.Fatalf("expecting error loading invalid session ticket keys")
+	}
+}
+
+func TestConnectionChurn(t *testing.T) {
+	// Setup a dedicated server, so that only the handshakes of this test are
+	// counted
+	fsrv, err := NewServer(churnServerAddr, certPath("localhost.pem"), certPath("localhost.key"), certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating a new Fileserver: %s", err)
+	}
+	go fsrv.Serve()
+	waitListening(churnServerAddr, t)
+
+	// The statistics are retrieved over a single connection
+	statsClient, err := NewClient(true, "", "", certPath("ca.pem"))
+	if err != nil {
+		t.Fatalf("failed creating new client %s", err)
+	}
+	defer statsClient.CloseIdleConnections()
+	before, err := statsClient.ServerStats(context.Background(), churnServerAddr)
+	if err != nil {
+		t.Fatalf("error retrieving server statistics: %s", err)
+	}
+
+	const downloads = 5
+	for _, useHttp1 := range []bool{true, false} {
+		client, err := NewClient(useHttp1, "", "", certPath("ca.pem"))
+		if err != nil {
+			t.Fatalf("failed creating new client %s", err)
+		}
+		client.DisableKeepAlives()
+		for i := 0; i < downloads; i++ {
+			report := client.DownloadFile(churnServerAddr, "churn", 1000, ChecksumNone, NONE, ioutil.Discard)
+			if report.Err != nil {
+				t.Fatalf("error downloading file: %s", report.Err)
+			}
+			if report.ConnReused || report.TLSHandshakes != 1 {
+				t.Fatalf("[http1=%t] download %d: expecting a new connection got reused=%t with %d handshakes", useHttp1, i, report.ConnReused, report.TLSHandshakes)
+			}
+		}
+	}
+
+	// Failed handshakes are not counted: a client which does not trust the
+	// server and a client which does not speak TLS
+	if conn, err := tls.Dial("tcp", churnServerAddr, &tls.Config{RootCAs: x509.NewCertPool()}); err == nil {
+		conn.Close()
+		t.Fatalf("expecting handshake with untrusted server to fail")
+	}
+	if conn, err := net.Dial("tcp", churnServerAddr); err == nil {
+		conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}
+
+	after, err := statsClient.ServerStats(context.Background(), churnServerAddr)
+	if err != nil {
+		t.Fatalf("error retrieving server statistics: %s", err)
+	}
+	if n := after.Handshakes - before.Handshakes; n != 2*downloads {
+		t.Fatalf("expecting %d handshakes got %d", 2*downloads, n)
+	}
+	if after.ResumedHandshakes != before.ResumedHandshakes {
+		t.Fatalf("unexpected resumed handshakes")
+	}
+	if after.CPUTime < before.CPUTime || !after.Time.After(before.Time) {
+		t.Fatalf("unexpected statistics before %+v and after %+v", before, after)
+	}
+}
+
+func TestChecksumCache(t *testing.T) {
+	cache := &checksumCache{sums: make(map[checksumKey][]byte)}
+	size := int64(3*MB + 7)
+	h := sha256.New()
+	writeContents(h, contentsBuffer, 0, size)
+	expected := h.Sum(nil)
+	for i := 0; i < 2; i++ {
+		sum := cache.sum(sha256.New(), SHA256, contentsBuffer, size)
+		if !bytes.Equal(sum, expected) {
+			t.Fatalf("[%d] expecting checksum %x got %x", i, expected, sum)
+		}
+	}
+	if len(cache.sums) != 1 {
+		t.Fatalf("expecting 1 cached checksum got %d", len(cache.sums))
+	}
+
+	// Files of other contents have other checksums
+	if sum := cache.sum(sha256.New(), SHA256, deterministicBuffer, size); bytes.Equal(sum, expected) {
+		t.Fatalf("expecting different checksums for different contents")
+	}
+
+	// The oldest checksums are evicted
+	for i := 0; i < checksumCacheSize; i++ {
+		cache.sum(crc32.New(crc32.MakeTable(crc32.Castagnoli)), CRC32C, contentsBuffer, int64(i+1))
+	}
+	if len(cache.sums) != checksumCacheSize || len(cache.order) != checksumCacheSize {
+		t.Fatalf("expecting %d cached checksums got %d", checksumCacheSize, len(cache.sums))
+	}
+	if _, ok := cache.sums[checksumKey{contents: &contentsBuffer[0], size: size, algo: SHA256}]; ok {
+		t.Fatalf("expecting oldest checksum to be evicted")
+	}
+}
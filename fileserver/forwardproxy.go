@@ -0,0 +1,96 @@
+package fileserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ProxyError is the error of a download whose forward proxy refused to open a
+// tunnel to the server, e.g. because the proxy requires authentication
+type ProxyError struct {
+	// Address of the proxy
+	Proxy string
+
+	// Status code and status line of the response to the CONNECT request
+	Code   int
+	Status string
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s responded to CONNECT with status %q", e.Proxy, e.Status)
+}
+
+// ParseProxyURL parses the URL of a forward proxy, of the form
+// http[s]://[user:password@]host:port. The user and password, if any, are sent
+// to the proxy in the 'Proxy-Authorization' header using the basic scheme.
+func ParseProxyURL(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid proxy URL %q: unsupported scheme %q", u.Redacted(), u.Scheme)
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", u.Redacted())
+	}
+	return u, nil
+}
+
+// phaseTraceKey is the context key of the phase trace of a request, which
+// the hooks of the transport related to proxies retrieve from the context of
+// the request or of the dial
+type phaseTraceKey struct{}
+
+// contextPhaseTrace returns the phase trace carried by ctx, if any
+func contextPhaseTrace(ctx context.Context) *phaseTrace {
+	t, _ := ctx.Value(phaseTraceKey{}).(*phaseTrace)
+	return t
+}
+
+// proxy returns the URL of the proxy the transport must use for req: the one
+// of the client, if set, or otherwise the one selected by the HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY environment variables. The transport does not call
+// it for requests sent over pooled HTTP/2 connections, so the downloads
+// resolve the proxy of each request themselves for reporting it.
+func (c *Client) proxy(req *http.Request) (*url.URL, error) {
+	if c.Proxy != nil {
+		return c.Proxy, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// proxyConnectHeader is called by the transport before it sends a CONNECT
+// request to a proxy, for recording the start of the tunnel establishment
+func proxyConnectHeader(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error) {
+	if t := contextPhaseTrace(ctx); t != nil {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.proxyConnectStart = time.Now()
+	}
+	return nil, nil
+}
+
+// proxyConnectResponse is called by the transport when it receives the
+// response of a proxy to a CONNECT request. It records the time the tunnel
+// establishment took and turns a refusal into a ProxyError.
+func proxyConnectResponse(ctx context.Context, proxyURL *url.URL, connectReq *http.Request, connectResp *http.Response) error {
+	if t := contextPhaseTrace(ctx); t != nil {
+		t.mu.Lock()
+		if !t.proxyConnectStart.IsZero() {
+			t.proxyConnectTime += time.Since(t.proxyConnectStart)
+		}
+		t.mu.Unlock()
+	}
+	if connectResp.StatusCode != http.StatusOK {
+		return &ProxyError{Proxy: proxyURL.Host, Code: connectResp.StatusCode, Status: connectResp.Status}
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package fileserver
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DownloadFileParallel downloads a file like DownloadFile but splits it into the given
+// number of byte ranges which are downloaded concurrently, each one in its own stream:
+// a HTTP/2 stream or, if the client uses HTTP/1, a connection.
+// If dst implements io.WriterAt, each range is written at its offset as it is received.
+// Otherwise, the ranges are written to dst in order, which requires buffering in memory
+// the data received for a range until the preceding ranges are complete.
+// The checksum, if any, covers the whole file. The server checksum is requested with
+// the first range only, so that the server hashes the file once. The report of each stream is included
+// in the Streams field of the returned report.
+func (c *Client) DownloadFileParallel(serverAddr string, fileID string, size int, streams int, chkMode ChecksumMode, chkAlgo ChecksumAlgorithm, dst io.Writer) (report DownloadReport) {
+	return c.DownloadFileParallelContext(context.Background(), serverAddr, fileID, size, streams, chkMode, chkAlgo, dst)
+}
+
+// DownloadFileParallelContext is like DownloadFileParallel but all the streams are aborted
+// when ctx is cancelled or its deadline expires.
+func (c *Client) DownloadFileParallelContext(ctx context.Context, serverAddr string, fileID string, size int, streams int, chkMode ChecksumMode, chkAlgo ChecksumAlgorithm, dst io.Writer) (report DownloadReport) {
+	if streams > size {
+		streams = size
+	}
+	if streams <= 1 {
+		return c.DownloadFileContext(ctx, serverAddr, fileID, size, chkMode, chkAlgo, singleStream(dst))
+	}
+	doRequestChecksum, digestName, err := c.checksumParams(chkMode, chkAlgo)
+	if err != nil {
+		report.Err = err
+		return
+	}
+
+	// The ranges are requested without content coding, so the query does not
+	// request compressible contents
+	return c.downloadParallel(ctx, download{
+		url:               c.fileURL(serverAddr, fileID, size, chkAlgo, doRequestChecksum, false),
+		chkMode:           chkMode,
+		chkAlgo:           chkAlgo,
+		doRequestChecksum: doRequestChecksum,
+		digestName:        digestName,
+	}, fileID, size, streams, dst)
+}
+
+// singleStream returns the writer of a file downloaded with a single stream
+// to dst. The contents are written with WriteAt if dst implements io.WriterAt,
+// as they are when downloaded with several streams.
+func singleStream(dst io.Writer) io.Writer {
+	if w, ok := dst.(io.WriterAt); ok && dst != ioutil.Discard {
+		return &offsetWriter{w: w}
+	}
+	return dst
+}
+
+// downloadParallel downloads the file specified by tmpl with the given number
+// of streams, each one downloading its range of the file with a copy of tmpl.
+// Only the first stream requests the server checksum, if tmpl does.
+func (c *Client) downloadParallel(ctx context.Context, tmpl download, fileID string, size int, streams int, dst io.Writer) (report DownloadReport) {
+	chkMode, chkAlgo := tmpl.chkMode, tmpl.chkAlgo
+	algorithm := getChecksumName(chkAlgo)
+	doRequestChecksum := tmpl.doRequestChecksum
+
+	// The checksum computed by the client requires the file contents in order
+	var chksumer hash.Hash
+	if chkMode == ChecksumClientOnly || chkMode == ChecksumClientAndServer {
+		chksumer, _ = getChecksumByKey(chkAlgo)
+	}
+	dstAt, isWriterAt := dst.(io.WriterAt)
+	if dst == ioutil.Discard {
+		// Discarded data can be written in any order
+		dstAt, isWriterAt = discardAt{}, true
+	}
+	var ordered *orderedWriter
+	switch {
+	case !isWriterAt && chksumer != nil:
+		ordered = newOrderedWriter(io.MultiWriter(dst, chksumer), streams)
+	case !isWriterAt:
+		ordered = newOrderedWriter(dst, streams)
+	case chksumer != nil:
+		ordered = newOrderedWriter(chksumer, streams)
+	}
+
+	// The server checksum, if any, covers the whole file and is requested with
+	// the first range only, so that the server hashes the file once
+	streamChkMode := ChecksumNone
+	if doRequestChecksum {
+		streamChkMode = ChecksumServerOnly
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	report.Streams = make([]DownloadReport, streams)
+	var wg sync.WaitGroup
+	s := c.startSampling(fileID)
+	report.Start = time.Now()
+	for i := 0; i < streams; i++ {
+		start, end := streamRange(int64(size), streams, i)
+		var w io.Writer
+		if isWriterAt {
+			w = &offsetWriter{w: dstAt, offset: start}
+		}
+		if ordered != nil {
+			if w != nil {
+				w = io.MultiWriter(w, ordered.stream(i))
+			} else {
+				w = ordered.stream(i)
+			}
+		}
+		w = s.writer(w)
+		dl := tmpl
+		dl.start, dl.end, dl.dst = start, end, w
+		dl.chkMode, dl.doRequestChecksum = ChecksumNone, false
+		if i == 0 {
+			dl.chkMode, dl.doRequestChecksum = streamChkMode, doRequestChecksum
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.runDownload(ctx, &dl, &report.Streams[i])
+			if report.Streams[i].Err != nil {
+				// Abort the other streams
+				cancel()
+				return
+			}
+			if ordered != nil {
+				ordered.close(i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	report.End = time.Now()
+	report.Samples = s.stop()
+
+	// Aggregate the reports of the streams
+	serverChecksum := ""
+	report.Verified, report.FirstMismatch = c.Verify, -1
+	for i, s := range report.Streams {
+		if i == 0 || s.TimeToFirstByte < report.TimeToFirstByte {
+			report.TimeToFirstByte = s.TimeToFirstByte
+		}
+		report.Bytes += s.Bytes
+		report.WireBytes += s.WireBytes
+		report.Redirects += s.Redirects
+		report.RedirectTime += s.RedirectTime
+		report.TokenValidationTime += s.TokenValidationTime
+		report.ThrottleTime += s.ThrottleTime
+		report.DNSTime += s.DNSTime
+		report.ConnectTime += s.ConnectTime
+		report.TLSHandshakeTime += s.TLSHandshakeTime
+		report.TLSHandshakes += s.TLSHandshakes
+		report.TLSResumedHandshakes += s.TLSResumedHandshakes
+		report.TLSResumedHandshakeTime += s.TLSResumedHandshakeTime
+		report.ProxyConnectTime += s.ProxyConnectTime
+		report.FirstResponseByteTime += s.FirstResponseByteTime
+		if report.Server == "" {
+			report.Server = s.Server
+			report.RemoteIP = s.RemoteIP
+			report.Proxy = s.Proxy
+			report.Protocol = s.Protocol
+			report.TLSVersion = s.TLSVersion
+			report.TLSCipherSuite = s.TLSCipherSuite
+		}
+		report.ConnReused = (i == 0 || report.ConnReused) && s.ConnReused
+		if s.Verified && s.FirstMismatch >= 0 && (report.FirstMismatch < 0 || s.FirstMismatch < report.FirstMismatch) {
+			report.FirstMismatch = s.FirstMismatch
+		}
+		report.CorruptedRanges += s.CorruptedRanges
+		report.CorruptedBytes += s.CorruptedBytes
+		if s.Err != nil && report.Err == nil {
+			report.Err = fmt.Errorf("stream %d: %w", i, s.Err)
+		}
+		if doRequestChecksum && i == 0 && s.Err == nil {
+			serverChecksum = strings.TrimPrefix(s.Checksum, algorithm+":")
+		}
+	}
+	report.ContentLength = int64(size)
+	if report.Err != nil {
+		return
+	}
+	if ordered != nil {
+		if err := ordered.err; err != nil {
+			report.Err = fmt.Errorf("error writing file contents: %s", err)
+			return
+		}
+	}
+
+	// Check the received checksum and the computed one actually match
+	clientCheckSum := ""
+	if chksumer != nil {
+		clientCheckSum = strings.ToLower(hex.EncodeToString(chksumer.Sum(nil)))
+	}
+	if chkMode == ChecksumClientAndServer && clientCheckSum != serverChecksum {
+		report.Err = fmt.Errorf("%w: computed checksum (%s) and received checksum (%s) do not match", ErrChecksumMismatch, clientCheckSum, serverChecksum)
+		return
+	}
+	switch {
+	case serverChecksum != "":
+		report.Checksum = fmt.Sprintf("%s:%s", algorithm, serverChecksum)
+	case clientCheckSum != "":
+		report.Checksum = fmt.Sprintf("%s:%s", algorithm, clientCheckSum)
+	}
+	return
+}
+
+// streamRange returns the first and last byte of the range of a file of the
+// given size downloaded by the i-th of streams. The sizes of the ranges differ
+// by one byte at most, so none is empty as long as streams <= size.
+func streamRange(size int64, streams, i int) (start, end int64) {
+	start = int64(i) * size / int64(streams)
+	end = int64(i+1)*size/int64(streams) - 1
+	return start, end
+}
+
+// offsetWriter writes sequentially to an io.WriterAt starting at an offset
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
+
+// discardAt is an io.WriterAt which discards the data written to it
+type discardAt struct{}
+
+func (discardAt) WriteAt(p []byte, off int64) (int, error) {
+	return len(p), nil
+}
+
+// orderedWriter reassembles in order the data of several streams, each one
+// carrying a consecutive part of the data, and writes it to an io.Writer. The
+// data of the current stream is written as it arrives, while the data of the
+// following streams is buffered until all the preceding streams are closed.
+type orderedWriter struct {
+	mu      sync.Mutex
+	dst     io.Writer
+	current int
+	buffers [][]byte
+	closed  []bool
+	err     error
+}
+
+func newOrderedWriter(dst io.Writer, streams int) *orderedWriter {
+	return &orderedWriter{
+		dst:     dst,
+		buffers: make([][]byte, streams),
+		closed:  make([]bool, streams),
+	}
+}
+
+// stream returns the writer for the i-th stream
+func (o *orderedWriter) stream(i int) io.Writer {
+	return &orderedStream{o: o, i: i}
+}
+
+// close records that all the data of the i-th stream was written
+func (o *orderedWriter) close(i int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed[i] = true
+	for o.current < len(o.closed) && o.closed[o.current] {
+		o.current++
+		if o.current < len(o.buffers) {
+			o.flush(o.current)
+		}
+	}
+}
+
+// flush writes the buffered data of the i-th stream. Must be called with the
+// lock held
+func (o *orderedWriter) flush(i int) {
+	if o.err == nil && len(o.buffers[i]) > 0 {
+		_, o.err = o.dst.Write(o.buffers[i])
+	}
+	o.buffers[i] = nil
+}
+
+type orderedStream struct {
+	o *orderedWriter
+	i int
+}
+
+func (s *orderedStream) Write(p []byte) (int, error) {
+	o := s.o
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err != nil {
+		return 0, o.err
+	}
+	if s.i != o.current {
+		o.buffers[s.i] = append(o.buffers[s.i], p...)
+		return len(p), nil
+	}
+	if _, err := o.dst.Write(p); err != nil {
+		o.err = err
+		return 0, err
+	}
+	return len(p), nil
+}
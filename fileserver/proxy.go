@@ -0,0 +1,171 @@
+package fileserver
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+var (
+	// Identifier of the extension of RFC 3820 proxy certificates
+	oidProxyCertInfo = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 14}
+
+	// Identifier of the same extension in pre-RFC (Globus Toolkit 3) proxies
+	oidProxyCertInfoDraft = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 3536, 1, 222}
+
+	// Identifier of the common name attribute of distinguished names
+	oidCommonName = asn1.ObjectIdentifier{2, 5, 4, 3}
+)
+
+// proxyCertInfo is the value of the extension of RFC 3820 proxy certificates
+type proxyCertInfo struct {
+	// Maximum number of proxy certificates which may follow this one in the
+	// chain, or -1 if unlimited
+	PathLen int `asn1:"optional,default:-1"`
+
+	Policy struct {
+		Language asn1.ObjectIdentifier
+		Policy   []byte `asn1:"optional"`
+	}
+}
+
+// isProxyCertificate returns true if the given certificate is a proxy
+// certificate, either as specified in RFC 3820 or a legacy (Globus Toolkit 2)
+// proxy whose subject ends with 'CN=proxy' or 'CN=limited proxy'
+func isProxyCertificate(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidProxyCertInfo) || ext.Id.Equal(oidProxyCertInfoDraft) {
+			return true
+		}
+	}
+	cn := cert.Subject.CommonName
+	return cn == "proxy" || cn == "limited proxy"
+}
+
+// endEntityCertificate returns the end-entity certificate of the given chain,
+// that is, the first certificate which is not a proxy certificate. The chain
+// starts with the leaf certificate. The leaf is returned if all the
+// certificates are proxies.
+func endEntityCertificate(chain []*x509.Certificate) *x509.Certificate {
+	for _, cert := range chain {
+		if !isProxyCertificate(cert) {
+			return cert
+		}
+	}
+	if len(chain) > 0 {
+		return chain[0]
+	}
+	return nil
+}
+
+// verifyProxyChain verifies a certificate chain presented by a client, which
+// may start with proxy certificates. Proxy certificates are rejected by the
+// standard verification since they are issued by end-entity certificates, so
+// each proxy is verified against its issuer as specified in RFC 3820 and the
+// end-entity certificate is verified against roots.
+func verifyProxyChain(chain []*x509.Certificate, roots *x509.CertPool) error {
+	now := time.Now()
+	i := 0
+	for ; i < len(chain) && isProxyCertificate(chain[i]); i++ {
+		if i+1 >= len(chain) {
+			return fmt.Errorf("proxy certificate %q without issuer", getCertName(chain[i].Subject))
+		}
+		if err := verifyProxyCertificate(chain[i], chain[i+1], i, now); err != nil {
+			return err
+		}
+	}
+	if i >= len(chain) {
+		return fmt.Errorf("no end-entity certificate in chain")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range chain[i+1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := chain[i].Verify(opts); err != nil {
+		return err
+	}
+	return nil
+}
+
+// verifyProxyCertificate verifies that proxy is a valid proxy certificate
+// issued by the given certificate. depth is the number of proxy certificates
+// issued below proxy in the chain.
+func verifyProxyCertificate(proxy, issuer *x509.Certificate, depth int, now time.Time) error {
+	name := getCertName(proxy.Subject)
+	if now.Before(proxy.NotBefore) || now.After(proxy.NotAfter) {
+		return fmt.Errorf("proxy certificate %q is expired or not yet valid", name)
+	}
+
+	// A proxy certificate must not be a certification authority, as specified
+	// in RFC 3820 section 3.8
+	if proxy.IsCA {
+		return fmt.Errorf("proxy certificate %q is a certification authority", name)
+	}
+
+	// The issuer must be allowed to sign and the subject of the proxy must be
+	// the subject of its issuer with one more common name
+	if issuer.KeyUsage != 0 && issuer.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return fmt.Errorf("issuer of proxy certificate %q cannot sign", name)
+	}
+	var subject, issuerSubject pkix.RDNSequence
+	if _, err := asn1.Unmarshal(proxy.RawSubject, &subject); err != nil {
+		return fmt.Errorf("invalid subject of proxy certificate %q [%s]", name, err)
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubject, &issuerSubject); err != nil {
+		return fmt.Errorf("invalid subject of proxy certificate issuer %q [%s]", getCertName(issuer.Subject), err)
+	}
+	last := len(subject) - 1
+	if last < 0 || !reflect.DeepEqual(subject[:last], issuerSubject) ||
+		len(subject[last]) != 1 || !subject[last][0].Type.Equal(oidCommonName) {
+		return fmt.Errorf("subject of proxy certificate %q does not extend the subject of its issuer", name)
+	}
+
+	// Verify the signature. CheckSignatureFrom cannot be used since it
+	// requires the issuer to be a certification authority
+	if err := issuer.CheckSignature(proxy.SignatureAlgorithm, proxy.RawTBSCertificate, proxy.Signature); err != nil {
+		return fmt.Errorf("invalid signature of proxy certificate %q [%s]", name, err)
+	}
+
+	// Enforce the path length constraint of RFC 3820 proxies
+	for _, ext := range proxy.Extensions {
+		if !ext.Id.Equal(oidProxyCertInfo) {
+			continue
+		}
+		var info proxyCertInfo
+		if _, err := asn1.Unmarshal(ext.Value, &info); err != nil {
+			return fmt.Errorf("invalid extension of proxy certificate %q [%s]", name, err)
+		}
+		if info.PathLen >= 0 && depth > info.PathLen {
+			return fmt.Errorf("proxy certificate %q exceeds path length constraint %d", name, info.PathLen)
+		}
+	}
+	return nil
+}
+
+// verifyClientCertificates returns a function for verifying the certificate
+// chains presented by clients during the TLS handshake against roots. Clients
+// which present no certificate are accepted.
+func verifyClientCertificates(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return nil
+		}
+		chain := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("invalid client certificate [%s]", err)
+			}
+			chain[i] = cert
+		}
+		return verifyProxyChain(chain, roots)
+	}
+}
@@ -0,0 +1,129 @@
+package fileserver
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate at which data is received. It may be shared by
+// several downloads, which are then collectively limited. It is safe for
+// concurrent use.
+type RateLimiter struct {
+	mu sync.Mutex
+
+	// Rate in bytes per second and maximum number of bytes received at once
+	rate  float64
+	burst int
+
+	// Number of bytes which may be received without waiting, negative if
+	// the receivers must wait, and time it was last updated
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter of the receive rate to the given number
+// of bytes per second
+func NewRateLimiter(bytesPerSec float64) *RateLimiter {
+	// Allow receiving up to 1/10th of a second worth of data at once, so
+	// that the rate is smooth at the scale of a TCP receive window
+	const minBurst = 16 * 1024
+	burst := int(bytesPerSec / 10)
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return &RateLimiter{
+		rate:   bytesPerSec,
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait accounts for n received bytes and waits until the rate of the limiter
+// allows receiving them or ctx is done. It returns the time spent waiting.
+func (l *RateLimiter) wait(ctx context.Context, n int) time.Duration {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return 0
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	return time.Since(now)
+}
+
+// rateLimiterKey is the key of the rate limiter in the context of a download
+type rateLimiterKey struct{}
+
+// ContextWithRateLimiter returns a copy of ctx which carries the given rate
+// limiter. Downloads performed with the returned context are limited by it, in
+// addition to the rate limiter of the client, if any. This allows for
+// limiting separately the downloads of each goroutine sharing a client.
+func ContextWithRateLimiter(ctx context.Context, l *RateLimiter) context.Context {
+	if l == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, rateLimiterKey{}, l)
+}
+
+// rateLimiters returns the rate limiters which apply to a download performed
+// with the given context
+func (c *Client) rateLimiters(ctx context.Context) []*RateLimiter {
+	var limiters []*RateLimiter
+	if c.RateLimiter != nil {
+		limiters = append(limiters, c.RateLimiter)
+	}
+	if l, ok := ctx.Value(rateLimiterKey{}).(*RateLimiter); ok {
+		limiters = append(limiters, l)
+	}
+	return limiters
+}
+
+// limitedReader is a reader whose receive rate is limited by a set of rate
+// limiters. It accounts for the time spent waiting for them.
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*RateLimiter
+	waited   time.Duration
+}
+
+// limitReader returns a reader of r limited by the rate limiters which apply
+// to a download performed with ctx, or r itself if there are none
+func (c *Client) limitReader(ctx context.Context, r io.Reader) io.Reader {
+	limiters := c.rateLimiters(ctx)
+	if len(limiters) == 0 {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	// Do not read more than the limiters allow at once
+	for _, l := range lr.limiters {
+		if len(p) > l.burst {
+			p = p[:l.burst]
+		}
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		for _, l := range lr.limiters {
+			lr.waited += l.wait(lr.ctx, n)
+		}
+	}
+	return n, err
+}
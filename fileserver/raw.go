@@ -0,0 +1,424 @@
+package fileserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The raw protocol is a minimal length-prefixed protocol for downloading files
+// over a TCP or TLS connection without HTTP, as a baseline for measuring the
+// overhead of HTTP. A request is made of:
+//
+//	magic "CHQ1" (4 bytes)
+//	size of the file (8 bytes, big endian)
+//	length of the file identifier (2 bytes, big endian)
+//	file identifier
+//
+// and its response of:
+//
+//	status: 0 for success, 1 for error (1 byte)
+//	length of the payload (8 bytes, big endian)
+//	payload: file contents or error message
+//
+// Several requests may be sent over the same connection, one after the other.
+
+const (
+	// Magic string which starts raw requests
+	rawMagic = "CHQ1"
+
+	// Status of raw responses
+	rawStatusOK    = 0
+	rawStatusError = 1
+
+	// Maximum length of the file identifier of a raw request
+	rawMaxFileID = 1024
+
+	// Maximum number of idle raw connections kept per server
+	rawMaxIdleConns = 100
+)
+
+// ServeRaw listens for raw protocol connections on addr and serves their
+// requests with random contents, like those of the files served via HTTP. If
+// secure is true, the connections are secured with TLS using the certificate
+// of this server. Raw requests are not authorized: any client may download files.
+func (fs *Server) ServeRaw(addr string, secure bool) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if secure {
+		config := fs.tlsConfig.Clone()
+		config.NextProtos = nil
+		ln = tls.NewListener(ln, config)
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go fs.serveRawConn(conn)
+	}
+}
+
+// serveRawConn serves the raw requests received over conn until the client
+// closes it
+func (fs *Server) serveRawConn(conn net.Conn) {
+	defer conn.Close()
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			log.Printf("Error serveRawConn: %s %s\n", conn.RemoteAddr(), err)
+			return
+		}
+		fs.countHandshake(tc.ConnectionState())
+	}
+	r := bufio.NewReader(conn)
+	for {
+		var header [len(rawMagic) + 8 + 2]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err != io.EOF {
+				log.Printf("Error serveRawConn: %s %s\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		start := time.Now()
+		if string(header[:len(rawMagic)]) != rawMagic {
+			writeRawError(conn, "invalid request")
+			return
+		}
+		size := int64(binary.BigEndian.Uint64(header[len(rawMagic):]))
+		idLen := int(binary.BigEndian.Uint16(header[len(rawMagic)+8:]))
+		if idLen > rawMaxFileID {
+			writeRawError(conn, "invalid request")
+			return
+		}
+		if err := checkSize(size); err != nil {
+			writeRawError(conn, err.Error())
+			return
+		}
+		fileID := make([]byte, idLen)
+		if _, err := io.ReadFull(r, fileID); err != nil {
+			log.Printf("Error serveRawConn: %s %s\n", conn.RemoteAddr(), err)
+			return
+		}
+		log.Printf("%s RAW GET %s %d\n", conn.RemoteAddr(), fileID, size)
+		if err := writeRawHeader(conn, rawStatusOK, size); err != nil {
+			return
+		}
+		if err := writeContents(conn, contentsBuffer, 0, size); err != nil {
+			log.Printf("Error serveRawConn: %s\n", err)
+			return
+		}
+		log.Printf("%s RAW GET %s %d %s\n", conn.RemoteAddr(), fileID, size, time.Now().Sub(start))
+	}
+}
+
+// writeRawHeader writes the header of a raw response
+func writeRawHeader(w io.Writer, status byte, length int64) error {
+	var header [9]byte
+	header[0] = status
+	binary.BigEndian.PutUint64(header[1:], uint64(length))
+	_, err := w.Write(header[:])
+	return err
+}
+
+// writeRawError writes a raw error response with the given message
+func writeRawError(w io.Writer, msg string) {
+	if err := writeRawHeader(w, rawStatusError, int64(len(msg))); err == nil {
+		io.WriteString(w, msg)
+	}
+}
+
+// RawServerError is the error of a raw download the server responded to with
+// an error message
+type RawServerError struct {
+	Message string
+}
+
+func (e *RawServerError) Error() string {
+	return fmt.Sprintf("server responded with error: %q", e.Message)
+}
+
+// rawPool holds the idle raw connections of a client, per server and security
+type rawPool struct {
+	mu    sync.Mutex
+	conns map[rawPoolKey][]net.Conn
+}
+
+type rawPoolKey struct {
+	addr   string
+	secure bool
+}
+
+// get returns an idle connection to the server, if any
+func (p *rawPool) get(key rawPoolKey) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.conns[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	conn := conns[len(conns)-1]
+	p.conns[key] = conns[:len(conns)-1]
+	return conn
+}
+
+// put keeps the connection to the server for a later download, unless there
+// are already too many idle connections to that server
+func (p *rawPool) put(key rawPoolKey, conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.conns[key]) >= rawMaxIdleConns {
+		conn.Close()
+		return
+	}
+	p.conns[key] = append(p.conns[key], conn)
+}
+
+// closeIdle closes all the idle connections
+func (p *rawPool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, conns := range p.conns {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		delete(p.conns, key)
+	}
+}
+
+// DownloadFileRaw downloads a file like DownloadFile but using the raw protocol
+// instead of HTTP. If secure is true, the connection to the server is secured
+// with TLS, using the certificates of this client. Only checksums computed by
+// the client are supported.
+func (c *Client) DownloadFileRaw(serverAddr string, fileID string, size int, secure bool, chkMode ChecksumMode, chkAlgo ChecksumAlgorithm, dst io.Writer) (report DownloadReport) {
+	return c.DownloadFileRawContext(context.Background(), serverAddr, fileID, size, secure, chkMode, chkAlgo, dst)
+}
+
+// DownloadFileRawContext is like DownloadFileRaw but the download is aborted when
+// ctx is cancelled or its deadline expires. The timeouts, the rate limiters and
+// the sampling interval of the client apply. Failed downloads are not retried.
+func (c *Client) DownloadFileRawContext(ctx context.Context, serverAddr string, fileID string, size int, secure bool, chkMode ChecksumMode, chkAlgo ChecksumAlgorithm, dst io.Writer) (report DownloadReport) {
+	if chkMode == ChecksumServerOnly || chkMode == ChecksumClientAndServer {
+		report.Err = fmt.Errorf("server checksums are not supported by the raw protocol")
+		return
+	}
+	algorithm := getChecksumName(chkAlgo)
+	if chkMode != ChecksumNone && algorithm == "" {
+		report.Err = fmt.Errorf("invalid requested checksum algorithm %v", chkAlgo)
+		return
+	}
+	if len(fileID) > rawMaxFileID {
+		report.Err = fmt.Errorf("file identifier longer than %d bytes", rawMaxFileID)
+		return
+	}
+	chksumer, _ := getChecksumByKey(chkAlgo)
+	if chkMode == ChecksumNone {
+		chksumer = nil
+	}
+	s := c.startSampling(fileID)
+	report.Start = time.Now()
+	attempt := DownloadAttempt{Start: report.Start}
+	defer func() {
+		report.End = time.Now()
+		attempt.End, attempt.Bytes, attempt.Err = report.End, report.Bytes, report.Err
+		report.Attempts = []DownloadAttempt{attempt}
+		report.Samples = s.stop()
+	}()
+
+	// Reuse an idle connection to the server or establish a new one
+	key := rawPoolKey{addr: serverAddr, secure: secure}
+	conn := c.rawConns.get(key)
+	report.ConnReused = conn != nil
+	if conn == nil {
+		var err error
+		if conn, err = c.dialRaw(ctx, serverAddr, secure, &report); err != nil {
+			report.Err = err
+			return
+		}
+	}
+	report.Server = serverAddr
+	report.Protocol = "RAW"
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		report.RemoteIP = host
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		report.TLSVersion = tls.VersionName(state.Version)
+		report.TLSCipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	}
+
+	// Abort the download when the context is done. The connection is kept
+	// for a later download only if this one succeeded and keep-alives are
+	// enabled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	reusable := false
+	keepAlive := !c.Client.Transport.(*http.Transport).DisableKeepAlives
+	defer func() {
+		if stop() && reusable && keepAlive {
+			conn.SetDeadline(time.Time{})
+			c.rawConns.put(key, conn)
+		} else {
+			conn.Close()
+		}
+	}()
+
+	// Send the request and wait for the response
+	request := make([]byte, 0, len(rawMagic)+8+2+len(fileID))
+	request = append(request, rawMagic...)
+	request = binary.BigEndian.AppendUint64(request, uint64(size))
+	request = binary.BigEndian.AppendUint16(request, uint16(len(fileID)))
+	request = append(request, fileID...)
+	if _, err := conn.Write(request); err != nil {
+		report.Err = c.rawError(ctx, err, "error sending request", 0)
+		return
+	}
+	if c.FirstByteTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.FirstByteTimeout))
+	}
+	sent := time.Now()
+	var header [9]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		if isTimeout(err) && ctx.Err() == nil {
+			err = &FirstByteTimeoutError{Timeout: c.FirstByteTimeout}
+		}
+		report.Err = c.rawError(ctx, err, "error receiving response", 0)
+		return
+	}
+	report.FirstResponseByteTime = time.Since(sent)
+	report.TimeToFirstByte = time.Since(report.Start)
+	conn.SetReadDeadline(time.Time{})
+	length := int64(binary.BigEndian.Uint64(header[1:]))
+	report.ContentLength = length
+	if header[0] != rawStatusOK {
+		msg := make([]byte, min(length, 4096))
+		n, _ := io.ReadFull(conn, msg)
+		report.Err = &RawServerError{Message: string(msg[:n])}
+		return
+	}
+
+	// Receive the file contents
+	var src io.Reader = &deadlineReader{conn: conn, timeout: c.StallTimeout}
+	limited := c.limitReader(ctx, src)
+	w := s.writer(dst)
+	if chksumer != nil {
+		w = io.MultiWriter(w, chksumer)
+	}
+	received, err := io.CopyN(w, limited, length)
+	report.Bytes, report.WireBytes = received, received
+	if lr, ok := limited.(*limitedReader); ok {
+		report.ThrottleTime = lr.waited
+	}
+	if err != nil {
+		if isTimeout(err) && ctx.Err() == nil && c.StallTimeout > 0 {
+			err = &StallError{Timeout: c.StallTimeout, Bytes: received}
+		}
+		report.Err = c.rawError(ctx, err, "error receiving file contents", received)
+		return
+	}
+	reusable = true
+	if length != int64(size) {
+		report.Err = fmt.Errorf("%w: response length %d does not match requested size %d", ErrLengthMismatch, length, size)
+		return
+	}
+	if chksumer != nil {
+		report.Checksum = fmt.Sprintf("%s:%s", algorithm, hex.EncodeToString(chksumer.Sum(nil)))
+	}
+	return
+}
+
+// dialRaw establishes a new raw connection to the server, recording the time
+// spent connecting and performing the TLS handshake in the report
+func (c *Client) dialRaw(ctx context.Context, serverAddr string, secure bool, report *DownloadReport) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.DialTimeout}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", serverAddr)
+	report.ConnectTime = time.Since(start)
+	if err != nil {
+		if isTimeout(err) && ctx.Err() == nil && c.DialTimeout > 0 {
+			return nil, &DialTimeoutError{Timeout: c.DialTimeout}
+		}
+		return nil, transportError(err)
+	}
+	if !secure {
+		return conn, nil
+	}
+	config := c.Client.Transport.(*http.Transport).TLSClientConfig.Clone()
+	if host, _, err := net.SplitHostPort(serverAddr); err == nil {
+		config.ServerName = host
+	}
+	tc := tls.Client(conn, config)
+	hsCtx := ctx
+	if c.TLSHandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		hsCtx, cancel = context.WithTimeout(ctx, c.TLSHandshakeTimeout)
+		defer cancel()
+	}
+	start = time.Now()
+	err = tc.HandshakeContext(hsCtx)
+	report.TLSHandshakeTime = time.Since(start)
+	if err != nil {
+		conn.Close()
+		if hsCtx.Err() != nil && ctx.Err() == nil {
+			return nil, &TLSHandshakeTimeoutError{Timeout: c.TLSHandshakeTimeout}
+		}
+		return nil, transportError(err)
+	}
+	report.TLSHandshakes = 1
+	if tc.ConnectionState().DidResume {
+		report.TLSResumedHandshakes = 1
+		report.TLSResumedHandshakeTime = report.TLSHandshakeTime
+	}
+	return tc, nil
+}
+
+// rawError returns the error of a raw download which failed with err after
+// receiving the given number of bytes of the file contents
+func (c *Client) rawError(ctx context.Context, err error, msg string, received int64) error {
+	var dialErr *DialTimeoutError
+	var firstByteErr *FirstByteTimeoutError
+	var stallErr *StallError
+	if errors.As(err, &dialErr) || errors.As(err, &firstByteErr) || errors.As(err, &stallErr) {
+		return err
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return transportError(fmt.Errorf("%s after %d bytes: %w", msg, received, err))
+}
+
+// isTimeout returns whether err is a timeout of a network operation
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// deadlineReader reads from a connection, which fails if no data is received
+// within the timeout, if not zero
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if d.timeout > 0 {
+		d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+	}
+	return d.conn.Read(p)
+}
@@ -0,0 +1,153 @@
+package fileserver
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RedirectStrategy specifies how a redirector selects the backend server it
+// redirects each file request to
+type RedirectStrategy int
+
+const (
+	// Select the backends in turn
+	RedirectRoundRobin RedirectStrategy = iota
+
+	// Select the backend according to a hash of the file identifier, so that
+	// requests for the same file are always redirected to the same backend
+	RedirectHash
+
+	// Select a backend at random
+	RedirectRandom
+)
+
+var (
+	// Names of the redirection strategies
+	redirectStrategyNames = map[RedirectStrategy]string{
+		RedirectRoundRobin: "roundrobin",
+		RedirectHash:       "hash",
+		RedirectRandom:     "random",
+	}
+)
+
+// RedirectStrategyByName returns the redirection strategy associated to the
+// given name (e.g. "roundrobin"). An error is returned if there is no such
+// strategy
+func RedirectStrategyByName(name string) (RedirectStrategy, error) {
+	name = strings.ToLower(name)
+	for k, v := range redirectStrategyNames {
+		if v == name {
+			return k, nil
+		}
+	}
+	return RedirectRoundRobin, fmt.Errorf("unknown redirection strategy %q", name)
+}
+
+// redirector answers file requests by redirecting them to one of its backend
+// file servers
+type redirector struct {
+	// Network addresses of the backend servers in the form "host:port"
+	backends []string
+
+	// Strategy for selecting a backend for each request
+	strategy RedirectStrategy
+
+	// HTTP status code of the redirection responses (e.g. 302)
+	code int
+
+	// Number of requests redirected so far, used for the round robin strategy
+	count uint64
+}
+
+// RedirectTo configures this server as a redirector: instead of serving files
+// it answers file requests with a redirection to one of the backend servers,
+// selected according to the given strategy. code is the HTTP status code of the
+// redirection responses, which must be either 302 or 307.
+func (fs *Server) RedirectTo(backends []string, strategy RedirectStrategy, code int) error {
+	if len(backends) == 0 {
+		return fmt.Errorf("no backend servers to redirect to")
+	}
+	if code != http.StatusFound && code != http.StatusTemporaryRedirect {
+		return fmt.Errorf("invalid redirection status code %d", code)
+	}
+	if _, ok := redirectStrategyNames[strategy]; !ok {
+		return fmt.Errorf("invalid redirection strategy %d", strategy)
+	}
+	fs.redirector = &redirector{
+		backends: backends,
+		strategy: strategy,
+		code:     code,
+	}
+	return nil
+}
+
+// selectBackend returns the network address of the backend server the request
+// for the given file must be redirected to
+func (r *redirector) selectBackend(fileID string) string {
+	n := uint64(len(r.backends))
+	switch r.strategy {
+	case RedirectHash:
+		h := fnv.New32a()
+		h.Write([]byte(fileID))
+		return r.backends[uint64(h.Sum32())%n]
+	case RedirectRandom:
+		return r.backends[rand.Intn(int(n))]
+	}
+	return r.backends[(atomic.AddUint64(&r.count, 1)-1)%n]
+}
+
+// handleRedirect handles GET requests for files by redirecting them to a
+// backend server. The query of the request is preserved.
+func (r *redirector) handleRedirect(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	if req.Method != http.MethodGet {
+		http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fileID := req.URL.Query().Get("id")
+	if len(fileID) == 0 {
+		http.Error(w, "400 Bad request: no id in query", http.StatusBadRequest)
+		return
+	}
+	backend := r.selectBackend(fileID)
+	location := "https://" + backend + req.URL.RequestURI()
+	http.Redirect(w, req, location, r.code)
+	log.Printf("%s %s %s %s %d %s %s\n", req.RemoteAddr, req.Proto, req.Method, req.RequestURI, r.code, backend, time.Since(start))
+}
+
+const (
+	// Maximum number of redirections a client follows for each request
+	maxRedirects = 10
+)
+
+// redirectTraceKey is the key of the redirectTrace in the context of a request
+type redirectTraceKey struct{}
+
+// redirectTrace records the redirections followed by the client for a request
+type redirectTrace struct {
+	// Number of redirections followed
+	hops int
+
+	// Time the last redirection response was received
+	last time.Time
+}
+
+// checkRedirect is the redirection policy of the fileserver clients. It
+// records the redirections followed for the request in the trace attached to
+// its context, if any
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if t, ok := req.Context().Value(redirectTraceKey{}).(*redirectTrace); ok {
+		t.hops = len(via)
+		t.last = time.Now()
+	}
+	return nil
+}
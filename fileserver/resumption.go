@@ -0,0 +1,63 @@
+package fileserver
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// LoadSessionTicketKeys reads the keys used by servers for encrypting and
+// decrypting TLS session tickets from a file holding one hex-encoded 32-byte
+// key per line. Servers which share the keys can resume the sessions
+// established with each other.
+func LoadSessionTicketKeys(file string) ([][32]byte, error) {
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session ticket keys file name '%s' [%s]", file, err)
+	}
+	blob, err := ioutil.ReadFile(absFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading session ticket keys file %s: %s", absFile, err)
+	}
+	var keys [][32]byte
+	for _, line := range strings.Fields(string(blob)) {
+		b, err := hex.DecodeString(line)
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("invalid session ticket keys file %s: expecting hex-encoded keys of 32 bytes", absFile)
+		}
+		var key [32]byte
+		copy(key[:], b)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("invalid session ticket keys file %s: no keys found", absFile)
+	}
+	return keys, nil
+}
+
+// SetSessionTicketKeys sets the keys this server uses for TLS session tickets.
+// The first key encrypts new tickets, all of them decrypt tickets. By default,
+// the server generates its own keys and rotates them periodically. It must be
+// called before the server starts serving.
+func (fs *Server) SetSessionTicketKeys(keys [][32]byte) {
+	fs.tlsConfig.SetSessionTicketKeys(keys)
+}
+
+// DisableSessionTickets prevents the clients from resuming the TLS sessions
+// they established with this server, so that each new connection requires a
+// full handshake. It must be called before the server starts serving.
+func (fs *Server) DisableSessionTickets() {
+	fs.tlsConfig.SessionTicketsDisabled = true
+}
+
+// SetSessionCache enables this client to resume the TLS sessions it
+// established with servers, which saves a round trip and the key exchange
+// for each new connection. The cache may be shared by several clients. A nil
+// cache disables session resumption, which is the default.
+func (c *Client) SetSessionCache(cache tls.ClientSessionCache) {
+	c.Client.Transport.(*http.Transport).TLSClientConfig.ClientSessionCache = cache
+}
@@ -0,0 +1,69 @@
+package fileserver
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default delays before the first retry of a download and maximum delay
+	// between two retries
+	DefaultInitialBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff     = 10 * time.Second
+)
+
+// RetryPolicy specifies how a client retries the downloads which fail because
+// of transient errors: network errors, interrupted response bodies and 429,
+// 500, 502, 503 and 504 responses
+type RetryPolicy struct {
+	// Maximum number of attempts of each download, including the first one.
+	// Downloads are not retried if it is less than 2
+	MaxAttempts int
+
+	// Delay before the first retry, doubled for each further retry up to
+	// MaxBackoff. A random jitter of up to half the delay is subtracted from
+	// each delay. If zero, the default values are used
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// delay returns the time to wait before the n-th retry (n >= 1) of a download
+func (p *RetryPolicy) delay(n int) time.Duration {
+	d, max := p.InitialBackoff, p.MaxBackoff
+	if d <= 0 {
+		d = DefaultInitialBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d - time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter parses the value of a 'Retry-After' header, which is either
+// a number of seconds or a date. It returns zero if the value is invalid or
+// refers to the past.
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(time.Now()) {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,396 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default template of the keys of the objects downloaded by the clients
+	DefaultS3KeyTemplate = "{id}-{size}"
+
+	// Default region of the S3 clients, which most S3-compatible servers accept
+	DefaultS3Region = "us-east-1"
+
+	// Maximum difference between the time of a signed request and the time of
+	// the server
+	s3MaxSkew = 15 * time.Minute
+
+	// Formats of the date and time of the SigV4 signatures
+	sigV4DateFormat = "20060102"
+	sigV4TimeFormat = "20060102T150405Z"
+
+	// SHA-256 hash of an empty payload, which is the payload of the GET requests
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Credentials holds the credentials used for signing requests to S3 servers
+// with AWS Signature Version 4 (SigV4)
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Session token of temporary credentials, if any
+	SessionToken string
+}
+
+// LoadS3Credentials reads S3 credentials from the given file, which contains
+// the access key identifier, the secret access key and, optionally, the session
+// token, separated by white space.
+func LoadS3Credentials(file string) (S3Credentials, error) {
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return S3Credentials{}, fmt.Errorf("invalid credentials file name '%s' [%s]", file, err)
+	}
+	blob, err := ioutil.ReadFile(absFile)
+	if err != nil {
+		return S3Credentials{}, fmt.Errorf("error loading credentials file %s: %s", absFile, err)
+	}
+	fields := strings.Fields(string(blob))
+	if len(fields) != 2 && len(fields) != 3 {
+		return S3Credentials{}, fmt.Errorf("invalid credentials file %s: expecting access key identifier, secret access key and optional session token", absFile)
+	}
+	creds := S3Credentials{AccessKeyID: fields[0], SecretAccessKey: fields[1]}
+	if len(fields) == 3 {
+		creds.SessionToken = fields[2]
+	}
+	return creds, nil
+}
+
+// S3Config specifies how a client downloads files as objects from S3-compatible
+// servers instead of via the '/file' path of chasqui file servers
+type S3Config struct {
+	// Bucket holding the objects
+	Bucket string
+
+	// Template of the object keys, where "{id}" and "{size}" are replaced by
+	// the identifier and the size of the downloaded file. The default is
+	// DefaultS3KeyTemplate, which suits chasqui file servers
+	KeyTemplate string
+
+	// Region the requests are signed for. The default is DefaultS3Region
+	Region string
+
+	// Credentials used for signing the requests. If the access key identifier
+	// is empty, the requests are sent anonymously
+	Credentials S3Credentials
+}
+
+// objectURL returns the URL of the object holding the given file, using path-style addressing
+func (s *S3Config) objectURL(serverAddr, fileID string, size int) *url.URL {
+	template := s.KeyTemplate
+	if template == "" {
+		template = DefaultS3KeyTemplate
+	}
+	key := strings.NewReplacer("{id}", fileID, "{size}", strconv.Itoa(size)).Replace(template)
+	return &url.URL{
+		Scheme: "https",
+		Host:   serverAddr,
+		Path:   "/" + s.Bucket + "/" + strings.TrimPrefix(key, "/"),
+	}
+}
+
+// sign adds a SigV4 signature to the request, if the configuration includes
+// credentials
+func (s *S3Config) sign(req *http.Request, now time.Time) {
+	creds := s.Credentials
+	if creds.AccessKeyID == "" {
+		return
+	}
+	region := s.Region
+	if region == "" {
+		region = DefaultS3Region
+	}
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+		signed = append(signed, "x-amz-security-token")
+	}
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", now.Format(sigV4DateFormat), region)
+	signature := sigV4Signature(req, creds.SecretAccessKey, scope, signed)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, strings.Join(signed, ";"), signature))
+}
+
+// DownloadObject downloads a file as an object from a S3-compatible server,
+// with requests signed according to s3, instead of via the '/file' path. The
+// object is split into the given number of byte ranges downloaded concurrently,
+// as with DownloadFileParallel. The servers do not compute checksums of
+// objects, so chkMode can only request the checksum computed by the client.
+func (c *Client) DownloadObject(s3 *S3Config, serverAddr string, fileID string, size int, streams int, chkMode ChecksumMode, chkAlgo ChecksumAlgorithm, dst io.Writer) (report DownloadReport) {
+	return c.DownloadObjectContext(context.Background(), s3, serverAddr, fileID, size, streams, chkMode, chkAlgo, dst)
+}
+
+// DownloadObjectContext is like DownloadObject but all the streams are aborted
+// when ctx is cancelled or its deadline expires.
+func (c *Client) DownloadObjectContext(ctx context.Context, s3 *S3Config, serverAddr string, fileID string, size int, streams int, chkMode ChecksumMode, chkAlgo ChecksumAlgorithm, dst io.Writer) (report DownloadReport) {
+	if chkMode == ChecksumServerOnly || chkMode == ChecksumClientAndServer {
+		report.Err = fmt.Errorf("server checksums are not supported with S3 objects")
+		return
+	}
+	if _, _, err := c.checksumParams(chkMode, chkAlgo); err != nil {
+		report.Err = err
+		return
+	}
+	dl := download{
+		url:     s3.objectURL(serverAddr, fileID, size),
+		sign:    func(req *http.Request) { s3.sign(req, time.Now()) },
+		chkMode: chkMode,
+		chkAlgo: chkAlgo,
+	}
+	if streams > size {
+		streams = size
+	}
+	if streams <= 1 {
+		dl.end, dl.dst = -1, singleStream(dst)
+		c.downloadWhole(ctx, &dl, fileID, &report)
+		return
+	}
+	return c.downloadParallel(ctx, dl, fileID, size, streams, dst)
+}
+
+// sigV4Signature returns the SigV4 signature of the request for the given
+// credential scope and list of signed headers, in lower case and sorted. The
+// request must include the 'X-Amz-Date' and 'X-Amz-Content-Sha256' headers.
+func sigV4Signature(req *http.Request, secret, scope string, signedHeaders []string) string {
+	// Canonical request
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(uriEncode(req.URL.Path, false) + "\n")
+	canonical.WriteString(canonicalQuery(req.URL.Query()) + "\n")
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		}
+		canonical.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonical.WriteString("\n" + strings.Join(signedHeaders, ";") + "\n")
+	canonical.WriteString(req.Header.Get("X-Amz-Content-Sha256"))
+	hashed := sha256.Sum256([]byte(canonical.String()))
+
+	// String to sign and signing key, derived from the secret and the scope
+	toSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode encodes s as specified by SigV4: all the bytes but the unreserved
+// characters of RFC 3986 are percent-encoded. Slashes are encoded only if
+// encodeSlash is true.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery returns the query parameters sorted by name and encoded as
+// specified by SigV4
+func canonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, v := range values {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// s3Service serves synthetic objects with S3-style responses
+type s3Service struct {
+	// Credentials the requests must be signed with. If the access key
+	// identifier is empty, requests are not authenticated
+	credentials S3Credentials
+
+	// Modification time reported for all the objects
+	modTime time.Time
+}
+
+// EnableS3 enables this server to serve synthetic objects at '/<bucket>/<key>'
+// paths with S3-style responses, in addition to the files at the '/file' path.
+// Any bucket exists and holds any object whose key ends with '-<size>', where
+// size is the size of the object in bytes. The contents of the objects are
+// deterministic, so that clients can verify them. If the access key identifier
+// of creds is not empty, the requests must be signed with these credentials
+// using SigV4.
+func (fs *Server) EnableS3(creds S3Credentials) {
+	fs.s3 = &s3Service{credentials: creds, modTime: time.Now().UTC().Truncate(time.Second)}
+}
+
+// s3ErrorResponse is the body of S3 error responses
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// s3Error sends an S3 error response with the given status and error code
+func s3Error(w http.ResponseWriter, req *http.Request, status int, code, format string, v ...interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if req.Method == http.MethodHead {
+		return
+	}
+	body, _ := xml.Marshal(&s3ErrorResponse{
+		Code:      code,
+		Message:   fmt.Sprintf(format, v...),
+		Resource:  req.URL.Path,
+		RequestID: w.Header().Get("X-Amz-Request-Id"),
+	})
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+// handleS3Object handles GET and HEAD requests for objects. The form of the
+// URL path must be /<bucket>/<key>
+func (fs *Server) handleS3Object(w http.ResponseWriter, req *http.Request) {
+	// Log this request
+	start := time.Now()
+	log.Printf("%s %s %s %s\n", req.RemoteAddr, req.Proto, req.Method, req.RequestURI)
+
+	var id [8]byte
+	rand.Read(id[:])
+	w.Header().Set("X-Amz-Request-Id", strings.ToUpper(hex.EncodeToString(id[:])))
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		s3Error(w, req, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		s3Error(w, req, http.StatusNotImplemented, "NotImplemented", "Only object requests are implemented.")
+		return
+	}
+	if code, err := fs.s3.authenticate(req, start); err != nil {
+		s3Error(w, req, http.StatusForbidden, code, "%s", err)
+		return
+	}
+	// The key ends with the size of the object, which is validated like the
+	// sizes of the files served at '/file'
+	key := parts[1]
+	sz := key[strings.LastIndex(key, "-")+1:]
+	if digits := strings.TrimRight(sz, "KMG"); digits == "" || strings.Trim(digits, "0123456789") != "" {
+		s3Error(w, req, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	size, err := parseSize(sz)
+	if err != nil {
+		s3Error(w, req, http.StatusBadRequest, "InvalidArgument", "Invalid object size: %s", err)
+		return
+	}
+
+	// Serve the requested range of the object, if any
+	offset, count, status := int64(0), size, http.StatusOK
+	if value := req.Header.Get("Range"); len(value) > 0 {
+		first, last, err := parseRange(value, size)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			s3Error(w, req, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable: %s", err)
+			return
+		}
+		offset, count, status = first, last-first+1, http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, size))
+	}
+	etag := sha256.Sum256([]byte(req.URL.Path))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(count, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(etag[:16])+`"`)
+	w.Header().Set("Last-Modified", fs.s3.modTime.Format(http.TimeFormat))
+	w.WriteHeader(status)
+	if req.Method == http.MethodGet {
+		if err := writeContents(w, deterministicBuffer, offset, count); err != nil {
+			log.Printf("Error handleS3Object: %s\n", err)
+		}
+	}
+	log.Printf("%s %s %s %s %d %s\n", req.RemoteAddr, req.Proto, req.Method, req.RequestURI, status, time.Now().Sub(start))
+}
+
+// authenticate verifies the SigV4 signature of the request, if the service
+// requires authentication. It returns the S3 error code and the error if the
+// request is not properly signed.
+func (s *s3Service) authenticate(req *http.Request, now time.Time) (string, error) {
+	creds := s.credentials
+	if creds.AccessKeyID == "" {
+		return "", nil
+	}
+	authz := req.Header.Get("Authorization")
+	if authz == "" {
+		return "AccessDenied", fmt.Errorf("Access Denied.")
+	}
+	const scheme = "AWS4-HMAC-SHA256 "
+	if !strings.HasPrefix(authz, scheme) {
+		return "InvalidRequest", fmt.Errorf("Unsupported authorization mechanism.")
+	}
+	params := map[string]string{}
+	for _, p := range strings.Split(authz[len(scheme):], ",") {
+		if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		}
+	}
+	credential := strings.SplitN(params["Credential"], "/", 2)
+	if len(credential) != 2 {
+		return "AuthorizationHeaderMalformed", fmt.Errorf("The authorization header is malformed.")
+	}
+	if credential[0] != creds.AccessKeyID {
+		return "InvalidAccessKeyId", fmt.Errorf("The AWS Access Key Id you provided does not exist in our records.")
+	}
+	date, err := time.Parse(sigV4TimeFormat, req.Header.Get("X-Amz-Date"))
+	if err != nil || !strings.HasPrefix(credential[1], date.Format(sigV4DateFormat)+"/") {
+		return "AuthorizationHeaderMalformed", fmt.Errorf("The authorization header is malformed: invalid date.")
+	}
+	if skew := now.Sub(date); skew > s3MaxSkew || skew < -s3MaxSkew {
+		return "RequestTimeTooSkewed", fmt.Errorf("The difference between the request time and the current time is too large.")
+	}
+	if creds.SessionToken != "" && req.Header.Get("X-Amz-Security-Token") != creds.SessionToken {
+		return "InvalidToken", fmt.Errorf("The provided token is malformed or otherwise invalid.")
+	}
+	signed := strings.Split(params["SignedHeaders"], ";")
+	expected := sigV4Signature(req, creds.SecretAccessKey, credential[1], signed)
+	if !hmac.Equal([]byte(expected), []byte(params["Signature"])) {
+		return "SignatureDoesNotMatch", fmt.Errorf("The request signature we calculated does not match the signature you provided.")
+	}
+	return "", nil
+}
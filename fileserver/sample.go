@@ -0,0 +1,106 @@
+package fileserver
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ThroughputSample records the number of bytes of a file received since the
+// start of its download
+type ThroughputSample struct {
+	// Time elapsed since the start of the download
+	Elapsed time.Duration
+
+	// Cumulative number of bytes received
+	Bytes int64
+}
+
+// sampler records the bytes received by a download at regular intervals.
+// A nil sampler records nothing.
+type sampler struct {
+	fileID   string
+	progress func(string, ThroughputSample)
+
+	// Number of bytes received, updated atomically
+	bytes int64
+
+	start   time.Time
+	samples []ThroughputSample
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// startSampling starts recording the bytes received by the download of the
+// given file, according to the sampling interval of the client. It returns
+// nil if sampling is disabled.
+func (c *Client) startSampling(fileID string) *sampler {
+	if c.SampleInterval <= 0 {
+		return nil
+	}
+	s := &sampler{
+		fileID:   fileID,
+		progress: c.Progress,
+		start:    time.Now(),
+		done:     make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(c.SampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.record()
+			}
+		}
+	}()
+	return s
+}
+
+// record appends a sample with the bytes received so far
+func (s *sampler) record() {
+	sample := ThroughputSample{
+		Elapsed: time.Since(s.start),
+		Bytes:   atomic.LoadInt64(&s.bytes),
+	}
+	s.samples = append(s.samples, sample)
+	if s.progress != nil {
+		s.progress(s.fileID, sample)
+	}
+}
+
+// writer returns a writer which accounts for the bytes written to w
+func (s *sampler) writer(w io.Writer) io.Writer {
+	if s == nil {
+		return w
+	}
+	return &samplingWriter{w: w, s: s}
+}
+
+// stop stops sampling and returns the samples recorded, the last one of which
+// accounts for all the bytes received
+func (s *sampler) stop() []ThroughputSample {
+	if s == nil {
+		return nil
+	}
+	close(s.done)
+	s.wg.Wait()
+	s.record()
+	return s.samples
+}
+
+type samplingWriter struct {
+	w io.Writer
+	s *sampler
+}
+
+func (sw *samplingWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	atomic.AddInt64(&sw.s.bytes, int64(n))
+	return n, err
+}
@@ -28,6 +28,27 @@ type Server struct {
 
 	// TLS configuration for this server
 	tlsConfig *tls.Config
+
+	// If not nil, this server redirects file requests to other servers
+	// instead of serving them
+	redirector *redirector
+
+	// If not nil, this server accepts third-party copy requests and uses this
+	// client for transferring files with other servers
+	tpcClient *Client
+
+	// Interval between two performance markers sent while a third-party copy
+	// is in progress
+	markerInterval time.Duration
+
+	// If not nil, this server accepts bearer tokens for authenticating clients
+	tokens *tokenValidator
+
+	// If not nil, this server serves synthetic objects with S3-style responses
+	s3 *s3Service
+
+	// Counters of the TLS handshakes, reported at the '/stats' path
+	counters serverCounters
 }
 
 const (
@@ -44,10 +65,14 @@ const (
 )
 
 var (
+	// Contents of the files: random, incompressible data
 	contentsBuffer []byte
+
+	// Contents of the files the client requested to be compressible
+	compressibleBuffer []byte
 )
 
-// init initializes the memory buffer used to send file contents
+// init initializes the memory buffers used to send file contents
 func init() {
 	rand.Seed(time.Now().UnixNano())
 	var b [bufferSize / 8]int64
@@ -57,6 +82,41 @@ func init() {
 	bfr := new(bytes.Buffer)
 	binary.Write(bfr, binary.LittleEndian, b)
 	contentsBuffer = bfr.Bytes()
+	compressibleBuffer = makeCompressibleBuffer(int(bufferSize))
+}
+
+// fileRequest holds the parameters of a file download request
+type fileRequest struct {
+	// File identifier and size in bytes
+	fileID string
+	size   int64
+
+	// Name of the hash algorithm requested by the client (e.g. "sha256"). If
+	// empty, no checksum is computed
+	checksumAlg string
+
+	// HTTP fields used for sending the checksum to the client
+	digestField DigestFields
+
+	// Whether the client requested compressible contents instead of random ones
+	compressible bool
+
+	// Whether the client requested deterministic contents, which it can verify
+	deterministic bool
+
+	// Whether the client requested the content length and the checksum to be
+	// sent up front as headers instead of as trailers
+	upfront bool
+
+	// Content coding to apply to the response body (e.g. "gzip"). If empty,
+	// the body is sent unencoded
+	encoding string
+
+	// If ranged is true, only the bytes from rangeStart to rangeEnd (both
+	// inclusive) of the file are sent
+	ranged     bool
+	rangeStart int64
+	rangeEnd   int64
 }
 
 // NewServer creates a new file server. The server will listen for HTTPS
@@ -104,8 +164,11 @@ func NewServer(addr, cert, key, ca string) (*Server, error) {
 			// This server's certificate chain
 			Certificates: []tls.Certificate{serverCert},
 
-			// Server policy for client authentication
-			ClientAuth: tls.VerifyClientCertIfGiven, // tls.RequireAndVerifyClientCert,
+			// Server policy for client authentication. The client certificates,
+			// if any, are verified by VerifyPeerCertificate instead of by the
+			// standard verification, which rejects proxy certificates
+			ClientAuth:            tls.RequestClientCert, // tls.RequireAndVerifyClientCert,
+			VerifyPeerCertificate: verifyClientCertificates(clientCAPool),
 
 			// Root certificate authorities used by this server to verify
 			// client certificates
@@ -141,12 +204,22 @@ func NewServer(addr, cert, key, ca string) (*Server, error) {
 // Serve listens for new incoming HTTP requests and serves them
 func (fs *Server) Serve() error {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/file", handleGetFile)
-	mux.HandleFunc("/", http.NotFound)
+	if fs.redirector != nil {
+		mux.HandleFunc("/file", fs.redirector.handleRedirect)
+	} else {
+		mux.HandleFunc("/file", fs.handleFile)
+	}
+	mux.HandleFunc("/stats", fs.handleStats)
+	if fs.s3 != nil {
+		mux.HandleFunc("/", fs.handleS3Object)
+	} else {
+		mux.HandleFunc("/", http.NotFound)
+	}
 	srv := &http.Server{
 		Addr:      fs.addr,
 		Handler:   mux,
 		TLSConfig: fs.tlsConfig,
+		ConnState: fs.trackConnState,
 		// ReadTimeout:  60 * time.Second,  // TODO: what these values should be?
 		// WriteTimeout: 60 * time.Second,
 		// IdleTimeout: 120 * time.Second, // Go v1.8 onwards
@@ -156,7 +229,7 @@ func (fs *Server) Serve() error {
 
 // handleGetFile handles GET requests for files. The form of the
 // URL path must be /file?id=<fileid>&size=<file size in bytes>
-func handleGetFile(w http.ResponseWriter, req *http.Request) {
+func (fs *Server) handleGetFile(w http.ResponseWriter, req *http.Request) {
 	// Log this request
 	start := time.Now()
 	log.Printf("%s %s %s %s\n", req.RemoteAddr, req.Proto, req.Method, req.RequestURI)
@@ -176,24 +249,9 @@ func handleGetFile(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	id, ok := query["id"]
-	if !ok || len(id) != 1 {
-		// File id not provided in the request or more than one is provided
-		http.Error(w, "400 Bad request: no id in query", http.StatusBadRequest)
-		return
-	}
-	fileID := id[0]
-
-	sz, ok := query["size"]
-	if !ok || len(sz) != 1 {
-		// File size not provided in the request or more than one size provided
-		http.Error(w, "400 Bad request: no file size in query", http.StatusBadRequest)
-		return
-	}
-	size, err := parseSize(sz[0])
+	fileID, size, err := parseFileQuery(query)
 	if err != nil {
-		// Could not parse the provided size
-		httpErrorf(w, http.StatusBadRequest, "400 Bad request: invalid size value %q", sz[0])
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -212,28 +270,68 @@ func handleGetFile(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	// Retrieve client's certificate, if any
-	isClientAnonymous := len(req.TLS.PeerCertificates) == 0
-	if isClientAnonymous {
-		// Ensure that an anonymous client can access the requested file
-		if !isAuthorized(fileID, size, "", "") {
-			http.Error(w, "403 Forbidden: you are not authorized to retrieve the requested file", http.StatusForbidden)
-			return
-		}
-	} else {
-		// Retrieve the client's certificate and make sure it is authorized
-		// to retrieve the requested file
-		for _, cert := range req.TLS.PeerCertificates {
-			issuer, subject := getCertName(cert.Issuer), getCertName(cert.Subject)
-			if !isAuthorized(fileID, size, subject, issuer) {
-				http.Error(w, "403 Forbidden: you are not authorized to retrieve the requested file", http.StatusForbidden)
-				return
+	// If no checksum was requested via the query, look for the standard digest
+	// fields. Algorithms we don't support are ignored, as per RFC 9530
+	digestField := DigestCustom
+	if checksumAlg == "" {
+		if want, ok := req.Header["Want-Repr-Digest"]; ok {
+			if algo := selectDigest(parseWantReprDigest(want)); algo != NONE {
+				checksumAlg, digestField = getChecksumName(algo), DigestRepr
+			}
+		} else if want, ok := req.Header["Want-Digest"]; ok {
+			if algo := selectDigest(parseWantDigest(want)); algo != NONE {
+				checksumAlg, digestField = getChecksumName(algo), DigestLegacy
 			}
 		}
 	}
 
+	// The file contents are random unless the client requested compressible or
+	// deterministic contents. Only compressible contents are encoded, if the
+	// client accepts so
+	compressible, deterministic, encoding := false, false, ""
+	if content := query.Get("content"); content == "compressible" {
+		compressible = true
+		encoding = negotiateEncoding(req.Header["Accept-Encoding"])
+	} else if content == "deterministic" {
+		deterministic = true
+	} else if content != "" && content != "random" {
+		httpErrorf(w, http.StatusBadRequest, "400 Bad request: invalid requested content %q", content)
+		return
+	}
+
+	// The client may request the content length and the checksum to be sent as
+	// headers, which is incompatible with encoding the contents on the fly
+	upfront := false
+	if length := query.Get("length"); length == "upfront" {
+		upfront, encoding = true, ""
+	} else if length != "" && length != "trailer" {
+		httpErrorf(w, http.StatusBadRequest, "400 Bad request: invalid requested length mode %q", length)
+		return
+	}
+
+	// The client may request a single range of the file, for instance for
+	// resuming an interrupted download. Ranges are sent unencoded
+	freq := &fileRequest{}
+	if value := req.Header.Get("Range"); len(value) > 0 {
+		if freq.rangeStart, freq.rangeEnd, err = parseRange(value, size); err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			httpErrorf(w, http.StatusRequestedRangeNotSatisfiable, "416 Requested range not satisfiable: %s", err)
+			return
+		}
+		freq.ranged, encoding = true, ""
+	}
+
+	// Ensure the client is authorized to retrieve the requested file
+	if !fs.authorizeRequest(w, req, tokenRead, fileID, size, "retrieve") {
+		return
+	}
+
 	// Serve file contents
-	status, err := serveFile(w, fileID, size, checksumAlg)
+	freq.fileID, freq.size = fileID, size
+	freq.checksumAlg, freq.digestField = checksumAlg, digestField
+	freq.compressible, freq.encoding, freq.upfront = compressible, encoding, upfront
+	freq.deterministic = deterministic
+	status, err := serveFile(w, freq)
 	if err != nil {
 		log.Printf("Error serveFile: %s\n", err)
 	}
@@ -243,12 +341,23 @@ func handleGetFile(w http.ResponseWriter, req *http.Request) {
 
 // serveFile sends the response to a GET HTTP request. The body of the response contains
 // the (made up) contents of the requested file.
-// checksumAlg is the name of the hash algorithm requested by the client (e.g. "sha256").
-// If checksumAlg is the empty string, no checksum is computed.
-func serveFile(w http.ResponseWriter, fileid string, size int64, checksumAlg string) (int, error) {
+// If a content coding is specified, the checksum sent via the 'Repr-Digest' field
+// is computed over the encoded body, as per RFC 9530. Otherwise, it is computed
+// over the file contents.
+// By default, the content length and the checksum are sent as trailers. If the
+// client requested them up front, they are sent as headers instead. Since the
+// file contents are made up, the checksum can be computed before sending them.
+// If a range of the file is requested, the checksum still covers the whole file,
+// so that the client can verify a download resumed from an interrupted one.
+// Checksums computed before sending the contents are cached, so that the ranges
+// of a file do not each require hashing the whole file.
+func serveFile(w http.ResponseWriter, freq *fileRequest) (int, error) {
+	checksumAlg, digestField, size := freq.checksumAlg, freq.digestField, freq.size
 	var hasher hash.Hash
+	var algo ChecksumAlgorithm
 	if checksumAlg != "" {
 		var err error
+		algo, _ = ChecksumAlgorithmByName(checksumAlg)
 		hasher, err = getChecksumByName(checksumAlg)
 		if err != nil {
 			// Should not happen because the caller checked that the specified checksum algorithm
@@ -260,37 +369,192 @@ func serveFile(w http.ResponseWriter, fileid string, size int64, checksumAlg str
 	}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Trailer", "X-Content-Length")
-	if hasher != nil {
+	w.Header().Set("Accept-Ranges", "bytes")
+	offset, count := int64(0), size
+	if freq.ranged {
+		offset, count = freq.rangeStart, freq.rangeEnd-freq.rangeStart+1
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", freq.rangeStart, freq.rangeEnd, size))
+	}
+	contents := contentsBuffer
+	if freq.compressible {
+		contents = compressibleBuffer
+		w.Header().Add("Vary", "Accept-Encoding")
+	} else if freq.deterministic {
+		contents = deterministicBuffer
+	}
+	if freq.encoding != "" {
+		w.Header().Set("Content-Encoding", freq.encoding)
+	}
+	if hasher != nil && digestField == DigestCustom {
 		w.Header().Set("X-Checksum-Algorithm", checksumAlg)
-		w.Header().Add("Trailer", "X-Checksum-Value")
+	}
+	var sum []byte
+	if hasher != nil && (freq.upfront || freq.ranged) {
+		// The caller ensures no content coding is applied in these cases
+		sum, hasher = fileChecksums.sum(hasher, algo, contents, size), nil
+	}
+	if freq.upfront {
+		// The caller ensures no content coding is applied, so the length of the
+		// response body is known in advance
+		w.Header().Set("Content-Length", strconv.FormatInt(count, 10))
+		if sum != nil {
+			w.Header().Set(checksumFieldName(digestField), formatChecksumField(digestField, algo, sum))
+		}
+	} else {
+		w.Header().Set("Trailer", "X-Content-Length")
+		if hasher != nil || sum != nil {
+			w.Header().Add("Trailer", checksumFieldName(digestField))
+		}
+	}
+	status := http.StatusOK
+	if freq.ranged {
+		status = http.StatusPartialContent
+		w.WriteHeader(status)
 	}
 
-	rdr := bytes.NewReader(contentsBuffer)
-	var src io.Reader = rdr
-	if hasher != nil {
+	var dst io.Writer = w
+	var encoder io.WriteCloser
+	if freq.encoding != "" {
+		// The checksum of the representation covers the encoded data
+		var encoded io.Writer = w
+		if hasher != nil && digestField == DigestRepr {
+			encoded = io.MultiWriter(w, hasher)
+		}
+		var err error
+		if encoder, err = newEncoder(freq.encoding, encoded); err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return http.StatusInternalServerError, err
+		}
+		dst = encoder
+	}
+	if hasher != nil && (encoder == nil || digestField != DigestRepr) {
 		// We need to compute checksum of the reponse body
-		src = io.TeeReader(rdr, hasher)
+		dst = io.MultiWriter(dst, hasher)
+	}
+	if err := writeContents(dst, contents, offset, count); err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return http.StatusInternalServerError, err
 	}
-	var err error
-	for remain, sent := size, int64(0); remain > 0; remain -= sent {
-		if rdr.Len() == 0 {
-			rdr.Seek(0, 0)
+	if encoder != nil {
+		// Flush the encoded data
+		if err := encoder.Close(); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("error encoding response body: %s", err)
 		}
-		count := min(int64(rdr.Len()), remain)
-		sent, err = io.CopyN(w, src, count)
+	}
+
+	// Send the content length and the checksum trailers
+	if !freq.upfront {
+		w.Header().Set("X-Content-Length", strconv.FormatInt(count, 10))
+		if hasher != nil {
+			sum = hasher.Sum(nil)
+		}
+		if sum != nil {
+			w.Header().Set(checksumFieldName(digestField), formatChecksumField(digestField, algo, sum))
+		}
+	}
+	return status, nil
+}
+
+// writeContents writes to dst count bytes of the file made up of the repeated
+// contents, starting at the specified offset
+func writeContents(dst io.Writer, contents []byte, offset, count int64) error {
+	pos := offset % int64(len(contents))
+	for remain := count; remain > 0; {
+		chunk := contents[pos:min(int64(len(contents)), pos+remain)]
+		sent, err := dst.Write(chunk)
 		if err != nil {
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			return http.StatusInternalServerError, fmt.Errorf("io.Copy error count=%d %s", count, err)
+			return fmt.Errorf("write error count=%d %s", len(chunk), err)
 		}
+		remain -= int64(sent)
+		pos = 0
+	}
+	return nil
+}
+
+// checksumFieldName returns the name of the HTTP field used for sending the
+// checksum to the client
+func checksumFieldName(digestField DigestFields) string {
+	switch digestField {
+	case DigestRepr:
+		return "Repr-Digest"
+	case DigestLegacy:
+		return "Digest"
 	}
+	return "X-Checksum-Value"
+}
 
-	// Send the content length and the checksum trailers
-	w.Header().Set("X-Content-Length", strconv.FormatInt(size, 10))
-	if hasher != nil {
-		w.Header().Set("X-Checksum-Value", hex.EncodeToString(hasher.Sum(nil)))
+// formatChecksumField formats the value of the HTTP field used for sending the
+// checksum to the client
+func formatChecksumField(digestField DigestFields, algo ChecksumAlgorithm, sum []byte) string {
+	if digestField == DigestCustom {
+		return hex.EncodeToString(sum)
 	}
-	return http.StatusOK, nil
+	return formatDigest(digestField, algo, sum)
+}
+
+// parseFileQuery retrieves the file identifier and the file size from the query
+// of a request
+func parseFileQuery(query url.Values) (string, int64, error) {
+	id, ok := query["id"]
+	if !ok || len(id) != 1 {
+		// File id not provided in the request or more than one is provided
+		return "", 0, fmt.Errorf("400 Bad request: no id in query")
+	}
+	sz, ok := query["size"]
+	if !ok || len(sz) != 1 {
+		// File size not provided in the request or more than one size provided
+		return "", 0, fmt.Errorf("400 Bad request: no file size in query")
+	}
+	size, err := parseSize(sz[0])
+	if err != nil {
+		// Could not parse the provided size
+		return "", 0, fmt.Errorf("400 Bad request: invalid size value %q", sz[0])
+	}
+	return id[0], size, nil
+}
+
+// parseRange parses the value of a 'Range' header requesting a single range of
+// bytes of a file of the given size, of one of the forms:
+//
+//	bytes=<first>-<last>
+//	bytes=<first>-
+//	bytes=-<suffix length>
+//
+// It returns the offsets of the first and last bytes of the range.
+func parseRange(value string, size int64) (int64, int64, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(value, prefix) {
+		return 0, 0, fmt.Errorf("unsupported range unit in %q", value)
+	}
+	spec := strings.TrimSpace(value[len(prefix):])
+	if strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("multiple ranges are not supported")
+	}
+	bounds := strings.SplitN(spec, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %q", spec)
+	}
+	first, last := strings.TrimSpace(bounds[0]), strings.TrimSpace(bounds[1])
+	if len(first) == 0 {
+		// Suffix range: the last bytes of the file
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid range %q", spec)
+		}
+		return size - min(n, size), size - 1, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, fmt.Errorf("invalid range %q", spec)
+	}
+	end := size - 1
+	if len(last) > 0 {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid range %q", spec)
+		}
+		end = min(end, size-1)
+	}
+	return start, end, nil
 }
 
 // parseSize parses a string representing the file size and returns the value
@@ -321,12 +585,21 @@ func parseSize(sz string) (int64, error) {
 	}
 	res *= factor
 
-	if res <= 0 || res > TB {
-		return 0, fmt.Errorf("invalid file size %d", res)
+	if err := checkSize(res); err != nil {
+		return 0, err
 	}
 	return res, nil
 }
 
+// checkSize returns an error if the size of a requested file is not within
+// the range served, that is, from 1 byte to 1 TB
+func checkSize(size int64) error {
+	if size <= 0 || size > TB {
+		return fmt.Errorf("invalid file size %d", size)
+	}
+	return nil
+}
+
 // getCertName retrieves and formats the given distinguished name of a certificate
 // Returns a string of the form:
 //    '/C=XX/ST=Province/L=Locality/O=Organizationy/OU=Organiational Unit/CN=Common Name'
@@ -357,6 +630,63 @@ func min(x, y int64) int64 {
 	return y
 }
 
+// authorizeRequest verifies that the client which emitted the request is
+// authorized to perform the given operation on the given file. A client which
+// presents a bearer token is authorized according to the scopes of the token,
+// otherwise according to its certificate, if any. If the client is not
+// authorized, an error response mentioning action is sent and false is returned.
+func (fs *Server) authorizeRequest(w http.ResponseWriter, req *http.Request, op tokenOperation, fileID string, size int64, action string) bool {
+	if authz := req.Header.Get("Authorization"); len(authz) > 0 {
+		if fs.tokens == nil {
+			http.Error(w, "401 Unauthorized: bearer tokens are not accepted by this server", http.StatusUnauthorized)
+			return false
+		}
+		if len(authz) < 7 || !strings.EqualFold(authz[:7], "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "401 Unauthorized: unsupported authorization scheme", http.StatusUnauthorized)
+			return false
+		}
+
+		// Report the time spent validating the token, for measuring its cost
+		start := time.Now()
+		claims, err := fs.tokens.validate(strings.TrimSpace(authz[7:]))
+		w.Header().Set("X-Token-Validation-Time", time.Since(start).String())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			httpErrorf(w, http.StatusUnauthorized, "401 Unauthorized: invalid bearer token: %s", err)
+			return false
+		}
+		if !claims.allows(op, fileID) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+			httpErrorf(w, http.StatusForbidden, "403 Forbidden: you are not authorized to %s the requested file", action)
+			return false
+		}
+		return true
+	}
+
+	// Retrieve client's certificate, if any
+	isClientAnonymous := len(req.TLS.PeerCertificates) == 0
+	if isClientAnonymous {
+		// Ensure that an anonymous client can access the requested file
+		if !isAuthorized(fileID, size, "", "") {
+			httpErrorf(w, http.StatusForbidden, "403 Forbidden: you are not authorized to %s the requested file", action)
+			return false
+		}
+		return true
+	}
+
+	// Make sure the client is authorized to access the requested file. The
+	// client is identified by its end-entity certificate, which issued the
+	// proxy certificates of its chain, if any
+	cert := endEntityCertificate(req.TLS.PeerCertificates)
+	issuer, subject := getCertName(cert.Issuer), getCertName(cert.Subject)
+	if !isAuthorized(fileID, size, subject, issuer) {
+		httpErrorf(w, http.StatusForbidden, "403 Forbidden: you are not authorized to %s the requested file", action)
+		return false
+	}
+	return true
+}
+
 // isAuthorized verfifies that the given user is authorized to download the
 // given file. The user is identified by their certificate subject and the
 // subject of the issuer. If no certificate is given, they user is considered anonymous.
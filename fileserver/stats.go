@@ -0,0 +1,116 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServerStats is a snapshot of the resource usage of a server, as served at
+// its '/stats' path. The rates of usage over a period are derived from two
+// snapshots. See Client.ServerStats
+type ServerStats struct {
+	// Time the snapshot was taken
+	Time time.Time `json:"time"`
+
+	// CPU time consumed by the server process since it started, in user and
+	// system mode. It is zero if the platform of the server does not report
+	// it
+	CPUTime time.Duration `json:"cpuTime"`
+
+	// Number of TLS handshakes completed by the server since it started, of
+	// which the number resumed a previous session
+	Handshakes        uint64 `json:"handshakes"`
+	ResumedHandshakes uint64 `json:"resumedHandshakes"`
+}
+
+// serverCounters holds the counters of a server, updated atomically
+type serverCounters struct {
+	handshakes        uint64
+	resumedHandshakes uint64
+
+	// HTTP connections whose handshake was counted, until they are closed
+	counted sync.Map
+}
+
+// countHandshake counts a TLS handshake completed by the server, full or
+// resumed
+func (fs *Server) countHandshake(state tls.ConnectionState) {
+	atomic.AddUint64(&fs.counters.handshakes, 1)
+	if state.DidResume {
+		atomic.AddUint64(&fs.counters.resumedHandshakes, 1)
+	}
+}
+
+// trackConnState is called on each state change of the HTTP connections of
+// the server. A connection becomes active once its handshake succeeded, and
+// then each time it starts serving requests, so its handshake is counted on
+// the first time only.
+func (fs *Server) trackConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateActive:
+		tc, ok := conn.(*tls.Conn)
+		if !ok {
+			return
+		}
+		if _, loaded := fs.counters.counted.LoadOrStore(conn, struct{}{}); !loaded {
+			fs.countHandshake(tc.ConnectionState())
+		}
+	case http.StateClosed, http.StateHijacked:
+		fs.counters.counted.Delete(conn)
+	}
+}
+
+// stats returns a snapshot of the resource usage of this server
+func (fs *Server) stats() ServerStats {
+	return ServerStats{
+		Time:              time.Now(),
+		CPUTime:           processCPUTime(),
+		Handshakes:        atomic.LoadUint64(&fs.counters.handshakes),
+		ResumedHandshakes: atomic.LoadUint64(&fs.counters.resumedHandshakes),
+	}
+}
+
+// handleStats handles GET requests for the resource usage of this server
+func (fs *Server) handleStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(fs.stats()); err != nil {
+		log.Printf("Error handleStats: %s\n", err)
+	}
+}
+
+// ServerStats retrieves a snapshot of the resource usage of the server. The
+// CPU consumed and the handshakes completed by the server during a period are
+// the differences between the snapshots taken at its start and at its end.
+func (c *Client) ServerStats(ctx context.Context, serverAddr string) (ServerStats, error) {
+	var stats ServerStats
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://%s/stats", serverAddr), nil)
+	if err != nil {
+		return stats, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return stats, transportError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return stats, &HTTPStatusError{Code: resp.StatusCode, Message: string(msg)}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return stats, fmt.Errorf("invalid statistics from server %s [%s]", serverAddr, err)
+	}
+	return stats, nil
+}
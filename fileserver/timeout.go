@@ -0,0 +1,177 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DialTimeoutError is the error of a download whose TCP connection to the
+// server was not established within the dial timeout of the client
+type DialTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *DialTimeoutError) Error() string {
+	return fmt.Sprintf("connection not established within %s", e.Timeout)
+}
+
+// TLSHandshakeTimeoutError is the error of a download whose TLS handshake with
+// the server did not complete within the handshake timeout of the client
+type TLSHandshakeTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TLSHandshakeTimeoutError) Error() string {
+	return fmt.Sprintf("TLS handshake not completed within %s", e.Timeout)
+}
+
+// FirstByteTimeoutError is the error of a download whose response did not
+// start within the time to first byte timeout of the client after the request
+// was written
+type FirstByteTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *FirstByteTimeoutError) Error() string {
+	return fmt.Sprintf("no response received within %s", e.Timeout)
+}
+
+// StallError is the error of a download which received no data for longer
+// than the stall timeout of the client while receiving the file contents
+type StallError struct {
+	Timeout time.Duration
+
+	// Number of bytes received from the network by the download before it
+	// stalled
+	Bytes int64
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("no data received for %s after %d bytes", e.Timeout, e.Bytes)
+}
+
+// watchdog aborts a download attempt when one of its phases exceeds the
+// corresponding timeout of the client. The hooks of its trace may be called
+// concurrently.
+type watchdog struct {
+	client *Client
+	cancel context.CancelCauseFunc
+
+	mu                                 sync.Mutex
+	dial, handshake, firstByte, stalls *time.Timer
+}
+
+// newWatchdog returns a context derived from ctx which is cancelled when a
+// phase of the request emitted with it exceeds its timeout, along with the
+// watchdog which enforces those timeouts
+func (c *Client) newWatchdog(ctx context.Context) (context.Context, *watchdog) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	w := &watchdog{client: c, cancel: cancel}
+	return httptrace.WithClientTrace(ctx, w.clientTrace()), w
+}
+
+// arm starts the timer t which aborts the attempt with err if it is not
+// disarmed within d. A zero duration means no timeout.
+func (w *watchdog) arm(t **time.Timer, d time.Duration, err error) {
+	if d <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if *t != nil {
+		(*t).Stop()
+	}
+	*t = time.AfterFunc(d, func() { w.cancel(err) })
+}
+
+// disarm stops the timer t, if started
+func (w *watchdog) disarm(t **time.Timer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if *t != nil {
+		(*t).Stop()
+		*t = nil
+	}
+}
+
+// clientTrace returns the hooks which start and stop the timers of the
+// phases of a request
+func (w *watchdog) clientTrace() *httptrace.ClientTrace {
+	c := w.client
+	return &httptrace.ClientTrace{
+		ConnectStart: func(string, string) {
+			w.arm(&w.dial, c.DialTimeout, &DialTimeoutError{Timeout: c.DialTimeout})
+		},
+		ConnectDone: func(string, string, error) {
+			w.disarm(&w.dial)
+		},
+		TLSHandshakeStart: func() {
+			w.arm(&w.handshake, c.TLSHandshakeTimeout, &TLSHandshakeTimeoutError{Timeout: c.TLSHandshakeTimeout})
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			w.disarm(&w.handshake)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			w.arm(&w.firstByte, c.FirstByteTimeout, &FirstByteTimeoutError{Timeout: c.FirstByteTimeout})
+		},
+		GotFirstResponseByte: func() {
+			w.disarm(&w.firstByte)
+		},
+	}
+}
+
+// body returns a reader of the response body which aborts the attempt if a
+// read waits for data from the network for longer than the stall timeout of
+// the client. received is the number of bytes received from the network before
+// this attempt. The time spent between reads, such as waiting for the rate
+// limiters or writing the data, does not count, so r must read directly from
+// the network.
+func (w *watchdog) body(r io.Reader, received int64) io.Reader {
+	timeout := w.client.StallTimeout
+	if timeout <= 0 {
+		return r
+	}
+	s := &stallReader{r: r, timeout: timeout, received: received}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s.timer = time.AfterFunc(timeout, func() {
+		w.cancel(&StallError{Timeout: timeout, Bytes: atomic.LoadInt64(&s.received)})
+	})
+	s.timer.Stop()
+	w.stalls = s.timer
+	return s
+}
+
+// stop stops all the timers of the watchdog and releases its context
+func (w *watchdog) stop() {
+	for _, t := range []**time.Timer{&w.dial, &w.handshake, &w.firstByte, &w.stalls} {
+		w.disarm(t)
+	}
+	w.cancel(nil)
+}
+
+// stallReader runs the stall timer of a watchdog while it waits for data
+type stallReader struct {
+	// Number of bytes received, updated atomically
+	received int64
+
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	s.timer.Reset(s.timeout)
+	n, err := s.r.Read(p)
+	s.timer.Stop()
+	if n > 0 {
+		atomic.AddInt64(&s.received, int64(n))
+	}
+	return n, err
+}
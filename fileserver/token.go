@@ -0,0 +1,321 @@
+package fileserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // register the hash functions used for verifying signatures
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Audience which designates any WLCG service, as per the WLCG common JWT
+	// profile
+	wlcgAnyAudience = "https://wlcg.cern.ch/jwt/v1/any"
+)
+
+// tokenOperation is the kind of access to a file a bearer token must grant
+type tokenOperation int
+
+const (
+	// Read a file
+	tokenRead tokenOperation = iota
+
+	// Create or overwrite a file
+	tokenWrite
+)
+
+// tokenValidator verifies JSON web tokens (JWT) presented by clients in the
+// 'Authorization' header of their requests
+type tokenValidator struct {
+	// Public keys of the token issuer, indexed by key identifier
+	keys map[string]crypto.PublicKey
+
+	// Expected issuer of the tokens, if not empty
+	issuer string
+
+	// Expected audience of the tokens, if not empty
+	audience string
+}
+
+// tokenClaims holds the claims of a token this server uses
+type tokenClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	Expiry    int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+	Scope     string          `json:"scope"`
+}
+
+// EnableTokens enables this server to authenticate clients which present a
+// bearer token in the 'Authorization' header of their requests, as an
+// alternative to their certificate. keys is the name of a JSON web key set
+// (JWKS) file containing the public keys of the token issuer. If issuer or
+// audience are not empty, the tokens must have been issued by issuer and must
+// be intended for audience, respectively.
+func (fs *Server) EnableTokens(keys, issuer, audience string) error {
+	absKeys, err := filepath.Abs(keys)
+	if err != nil {
+		return fmt.Errorf("invalid key set file name '%s' [%s]", keys, err)
+	}
+	blob, err := ioutil.ReadFile(absKeys)
+	if err != nil {
+		return fmt.Errorf("error loading key set file %s: %s", absKeys, err)
+	}
+	keySet, err := parseKeySet(blob)
+	if err != nil {
+		return fmt.Errorf("error parsing key set file %s: %s", absKeys, err)
+	}
+	fs.tokens = &tokenValidator{
+		keys:     keySet,
+		issuer:   issuer,
+		audience: audience,
+	}
+	return nil
+}
+
+// parseKeySet parses a JSON web key set and returns the RSA and EC public keys
+// it contains, indexed by their key identifier
+func parseKeySet(blob []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(blob, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			default:
+				return nil, fmt.Errorf("unsupported curve %q for key %q", k.Crv, k.Kid)
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no supported keys in key set")
+	}
+	return keys, nil
+}
+
+// validate verifies the signature and the validity of the given token and
+// returns its claims
+func (v *tokenValidator) validate(token string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header [%s]", err)
+	}
+	key, ok := v.keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature [%s]", err)
+	}
+	if err := verifyTokenSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims tokenClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims [%s]", err)
+	}
+	now := time.Now().Unix()
+	if claims.Expiry == 0 || now >= claims.Expiry {
+		return nil, fmt.Errorf("expired token")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("unexpected token issuer %q", claims.Issuer)
+	}
+	if v.audience != "" && !claims.hasAudience(v.audience) && !claims.hasAudience(wlcgAnyAudience) {
+		return nil, fmt.Errorf("token not intended for audience %q", v.audience)
+	}
+	return &claims, nil
+}
+
+// decodeTokenPart decodes a base64url-encoded JSON part of a token into v
+func decodeTokenPart(part string, v interface{}) error {
+	blob, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(blob, v)
+}
+
+// verifyTokenSignature verifies the signature of the signed part of a token
+// computed with the given algorithm
+func verifyTokenSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var h crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h = crypto.SHA256
+	case "RS384", "ES384":
+		h = crypto.SHA384
+	case "RS512":
+		h = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+	hasher := h.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			return fmt.Errorf("signature algorithm %q does not match RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, h, digest, sig); err != nil {
+			return fmt.Errorf("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size {
+			return fmt.Errorf("signature algorithm %q does not match EC key", alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+	}
+	return nil
+}
+
+// hasAudience returns true if the 'aud' claim, which is either a string or an
+// array of strings, contains the given audience
+func (c *tokenClaims) hasAudience(audience string) bool {
+	var single string
+	if err := json.Unmarshal(c.Audience, &single); err == nil {
+		return single == audience
+	}
+	var multiple []string
+	if err := json.Unmarshal(c.Audience, &multiple); err == nil {
+		for _, a := range multiple {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allows returns true if the scopes of the token grant the given operation on
+// the given file. Scopes are of the form 'storage.read:/path', as per the WLCG
+// common JWT profile, and the path of a file is its identifier prefixed with '/'.
+func (c *tokenClaims) allows(op tokenOperation, fileID string) bool {
+	path := "/" + strings.TrimPrefix(fileID, "/")
+	for _, scope := range strings.Fields(c.Scope) {
+		kv := strings.SplitN(scope, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "storage.read":
+			if op != tokenRead {
+				continue
+			}
+		case "storage.create", "storage.modify":
+			if op != tokenWrite {
+				continue
+			}
+		default:
+			continue
+		}
+		prefix := strings.TrimSuffix(kv[1], "/")
+		if prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadToken reads the bearer token this client sends to the servers from the
+// given file. Leading and trailing white space in the file is ignored.
+func (c *Client) LoadToken(file string) error {
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return fmt.Errorf("invalid token file name '%s' [%s]", file, err)
+	}
+	blob, err := ioutil.ReadFile(absFile)
+	if err != nil {
+		return fmt.Errorf("error loading token file %s: %s", absFile, err)
+	}
+	token := strings.TrimSpace(string(blob))
+	if len(token) == 0 {
+		return fmt.Errorf("empty token file %s", absFile)
+	}
+	c.Token = token
+	return nil
+}
+
+// setAuthorization adds the bearer token of this client, if any, to the request
+func (c *Client) setAuthorization(req *http.Request) {
+	if len(c.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+}
+
+// tokenValidationTime returns the time the server reports it spent validating
+// the bearer token of the request or zero if it did not report it
+func tokenValidationTime(resp *http.Response) time.Duration {
+	d, err := time.ParseDuration(resp.Header.Get("X-Token-Validation-Time"))
+	if err != nil {
+		return 0
+	}
+	return d
+}
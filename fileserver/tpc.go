@@ -0,0 +1,428 @@
+package fileserver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// HTTP method for requesting a third-party copy
+	methodCopy = "COPY"
+
+	// Default interval between two performance markers sent while a third-party
+	// copy is in progress
+	DefaultMarkerInterval = 5 * time.Second
+)
+
+// CopyMode specifies how a third-party copy is performed
+type CopyMode int
+
+const (
+	// Not a third-party copy
+	CopyNone CopyMode = iota
+
+	// The active server pulls the file from the remote server, specified
+	// in the 'Source' header of the COPY request
+	CopyPull
+
+	// The active server pushes the file to the remote server, specified
+	// in the 'Destination' header of the COPY request
+	CopyPush
+)
+
+// EnableThirdPartyCopy enables this server to accept third-party copy requests,
+// as specified by the WLCG HTTP-TPC protocol. The server uses the given client
+// for pulling files from or pushing them to other servers and sends a performance
+// marker to the requester every markerInterval while the copy is in progress.
+func (fs *Server) EnableThirdPartyCopy(c *Client, markerInterval time.Duration) {
+	if markerInterval <= 0 {
+		markerInterval = DefaultMarkerInterval
+	}
+	fs.tpcClient = c
+	fs.markerInterval = markerInterval
+}
+
+// handleFile dispatches the requests for files according to their method
+func (fs *Server) handleFile(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPut:
+		fs.handlePutFile(w, req)
+	case methodCopy:
+		if fs.tpcClient == nil {
+			http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fs.handleCopy(w, req)
+	default:
+		fs.handleGetFile(w, req)
+	}
+}
+
+// handlePutFile handles PUT requests for files. The form of the URL path
+// must be /file?id=<fileid>&size=<file size in bytes>. The contents of the
+// file, in the body of the request, are discarded.
+func (fs *Server) handlePutFile(w http.ResponseWriter, req *http.Request) {
+	// Log this request
+	start := time.Now()
+	log.Printf("%s %s %s %s\n", req.RemoteAddr, req.Proto, req.Method, req.RequestURI)
+
+	fileID, size, err := parseFileQuery(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !fs.authorizeRequest(w, req, tokenWrite, fileID, size, "store") {
+		return
+	}
+
+	// Receive the file contents
+	received, err := io.Copy(ioutil.Discard, req.Body)
+	if err != nil {
+		httpErrorf(w, http.StatusBadRequest, "400 Bad request: error receiving file contents: %s", err)
+		return
+	}
+	if received != size {
+		httpErrorf(w, http.StatusBadRequest, "400 Bad request: received %d bytes, expecting %d", received, size)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	log.Printf("%s %s %s %s %d %s\n", req.RemoteAddr, req.Proto, req.Method, req.RequestURI, http.StatusCreated, time.Since(start))
+}
+
+// handleCopy handles third-party copy requests. The form of the URL path must
+// be /file?id=<fileid>&size=<file size in bytes> and the request must include
+// either a 'Source' header, for pulling the file from the server specified in
+// its URL, or a 'Destination' header, for pushing the file to that server.
+// The file identifier and size are the same at both ends of the copy.
+// While the copy is in progress, performance markers are sent in the body of
+// the response which ends with a line stating whether the copy succeeded.
+func (fs *Server) handleCopy(w http.ResponseWriter, req *http.Request) {
+	// Log this request
+	start := time.Now()
+	log.Printf("%s %s %s %s\n", req.RemoteAddr, req.Proto, req.Method, req.RequestURI)
+
+	fileID, size, err := parseFileQuery(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Determine the copy mode and the remote server
+	source, destination := req.Header.Get("Source"), req.Header.Get("Destination")
+	mode, remote := CopyPull, source
+	if len(source) == 0 {
+		mode, remote = CopyPush, destination
+	}
+	if (len(source) == 0) == (len(destination) == 0) {
+		http.Error(w, "400 Bad request: exactly one of 'Source' or 'Destination' headers is required", http.StatusBadRequest)
+		return
+	}
+	remoteURL, err := url.Parse(remote)
+	if err != nil || remoteURL.Scheme != "https" || len(remoteURL.Host) == 0 {
+		httpErrorf(w, http.StatusBadRequest, "400 Bad request: invalid remote URL %q", remote)
+		return
+	}
+	// Pulling a file writes it to this server while pushing it reads it
+	op := tokenWrite
+	if mode == CopyPush {
+		op = tokenRead
+	}
+	if !fs.authorizeRequest(w, req, op, fileID, size, "copy") {
+		return
+	}
+
+	// Start the copy
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	flush(w)
+	progress := &progressCounter{}
+	done := make(chan error, 1)
+	go func() {
+		switch mode {
+		case CopyPull:
+			report := fs.tpcClient.DownloadFileContext(req.Context(), remoteURL.Host, fileID, int(size), ChecksumNone, NONE, progress)
+			done <- report.Err
+		case CopyPush:
+			src := io.TeeReader(newContentsReader(contentsBuffer, size), progress)
+			report := fs.tpcClient.UploadFileContext(req.Context(), remoteURL.Host, fileID, int(size), src)
+			done <- report.Err
+		}
+	}()
+
+	// Send performance markers until the copy ends
+	ticker := time.NewTicker(fs.markerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			writePerfMarker(w, progress.count())
+			flush(w)
+		case err := <-done:
+			writePerfMarker(w, progress.count())
+			status := http.StatusCreated
+			if err != nil {
+				status = http.StatusInternalServerError
+				fmt.Fprintf(w, "failure: %s\n", err)
+			} else {
+				fmt.Fprintf(w, "success: Created\n")
+			}
+			log.Printf("%s %s %s %s %s %d %s\n", req.RemoteAddr, req.Proto, req.Method, req.RequestURI, remoteURL.Host, status, time.Since(start))
+			return
+		}
+	}
+}
+
+// writePerfMarker writes a performance marker in the format specified by the
+// WLCG HTTP-TPC protocol
+func writePerfMarker(w io.Writer, transferred int64) {
+	fmt.Fprintf(w, "Perf Marker\n")
+	fmt.Fprintf(w, "\tTimestamp: %d\n", time.Now().Unix())
+	fmt.Fprintf(w, "\tStripe Index: 0\n")
+	fmt.Fprintf(w, "\tStripe Bytes Transferred: %d\n", transferred)
+	fmt.Fprintf(w, "\tTotal Stripe Count: 1\n")
+	fmt.Fprintf(w, "End\n")
+}
+
+// flush sends any buffered data to the client
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// progressCounter is a writer which counts the bytes written to it. It is safe
+// for concurrent use.
+type progressCounter struct {
+	n int64
+}
+
+func (p *progressCounter) Write(b []byte) (int, error) {
+	atomic.AddInt64(&p.n, int64(len(b)))
+	return len(b), nil
+}
+
+func (p *progressCounter) count() int64 {
+	return atomic.LoadInt64(&p.n)
+}
+
+// contentsReader is a reader of size bytes of the file made up of the
+// repeated contents
+type contentsReader struct {
+	contents []byte
+	pos      int
+	remain   int64
+}
+
+func newContentsReader(contents []byte, size int64) *contentsReader {
+	return &contentsReader{contents: contents, remain: size}
+}
+
+func (r *contentsReader) Read(p []byte) (int, error) {
+	if r.remain <= 0 {
+		return 0, io.EOF
+	}
+	if r.pos == len(r.contents) {
+		r.pos = 0
+	}
+	chunk := r.contents[r.pos:]
+	if int64(len(chunk)) > r.remain {
+		chunk = chunk[:r.remain]
+	}
+	n := copy(p, chunk)
+	r.pos += n
+	r.remain -= int64(n)
+	return n, nil
+}
+
+type UploadReport struct {
+	// Start and end times of the upload operation
+	Start time.Time
+	End   time.Time
+
+	// Number of bytes of the file contents sent to the server
+	Bytes int64
+
+	// Error, may be nil
+	Err error
+}
+
+// UploadFile emits a HTTP PUT request against the specified server to upload a file given its
+// file identifier and size (in bytes). The contents of the file are read from src.
+func (c *Client) UploadFile(serverAddr string, fileID string, size int, src io.Reader) (report UploadReport) {
+	return c.UploadFileContext(context.Background(), serverAddr, fileID, size, src)
+}
+
+// UploadFileContext is like UploadFile but the upload is aborted when ctx is cancelled
+// or its deadline expires. The number of bytes sent until then is recorded in the report.
+func (c *Client) UploadFileContext(ctx context.Context, serverAddr string, fileID string, size int, src io.Reader) (report UploadReport) {
+	u := &url.URL{
+		Scheme: "https",
+		Host:   serverAddr,
+		Path:   "/file",
+	}
+	q := u.Query()
+	q.Set("id", fileID)
+	q.Set("size", fmt.Sprintf("%d", size))
+	u.RawQuery = q.Encode()
+	sent := &progressCounter{}
+	req, err := http.NewRequest(http.MethodPut, u.String(), io.TeeReader(src, sent))
+	if err != nil {
+		report.Err = err
+		return
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = int64(size)
+	c.setAuthorization(req)
+	report.Start = time.Now()
+	resp, err := c.Do(req)
+	report.End = time.Now()
+	report.Bytes = sent.count()
+	if err != nil {
+		report.Err = transportError(err)
+		return
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		report.Err = &HTTPStatusError{Code: resp.StatusCode, Message: string(body)}
+	}
+	return
+}
+
+// PerfMarker is a performance marker received while a third-party copy is in progress
+type PerfMarker struct {
+	// Time the marker was emitted by the active server
+	Timestamp time.Time
+
+	// Number of bytes transferred so far
+	Bytes int64
+}
+
+type CopyReport struct {
+	// Start and end times of the copy operation
+	Start time.Time
+	End   time.Time
+
+	// Performance markers received from the active server
+	Markers []PerfMarker
+
+	// Number of bytes transferred, according to the last performance marker
+	Bytes int64
+
+	// Error, may be nil
+	Err error
+}
+
+// CopyFile requests the active server to perform a third-party copy of a file, given its file
+// identifier and size (in bytes), with the remote server. Depending on mode, the active
+// server either pulls the file from the remote server or pushes it to the remote server.
+func (c *Client) CopyFile(activeAddr, remoteAddr string, fileID string, size int, mode CopyMode) (report CopyReport) {
+	return c.CopyFileContext(context.Background(), activeAddr, remoteAddr, fileID, size, mode)
+}
+
+// CopyFileContext is like CopyFile but the request is aborted when ctx is cancelled or
+// its deadline expires, which makes the active server abort the copy. The performance
+// markers received until then are recorded in the report.
+func (c *Client) CopyFileContext(ctx context.Context, activeAddr, remoteAddr string, fileID string, size int, mode CopyMode) (report CopyReport) {
+	u := &url.URL{
+		Scheme: "https",
+		Host:   activeAddr,
+		Path:   "/file",
+	}
+	q := u.Query()
+	q.Set("id", fileID)
+	q.Set("size", fmt.Sprintf("%d", size))
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(methodCopy, u.String(), nil)
+	if err != nil {
+		report.Err = err
+		return
+	}
+	req = req.WithContext(ctx)
+	remote := &url.URL{
+		Scheme:   "https",
+		Host:     remoteAddr,
+		Path:     "/file",
+		RawQuery: u.RawQuery,
+	}
+	switch mode {
+	case CopyPull:
+		req.Header.Set("Source", remote.String())
+	case CopyPush:
+		req.Header.Set("Destination", remote.String())
+	default:
+		report.Err = fmt.Errorf("invalid copy mode %d", mode)
+		return
+	}
+	c.setAuthorization(req)
+	report.Start = time.Now()
+	resp, err := c.Do(req)
+	if err != nil {
+		report.Err = transportError(err)
+		return
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusAccepted {
+		body, _ := ioutil.ReadAll(resp.Body)
+		report.Err = &HTTPStatusError{Code: resp.StatusCode, Message: string(body)}
+		return
+	}
+
+	// Receive the performance markers until the active server reports the
+	// result of the copy
+	report.Markers, report.Err = readPerfMarkers(resp.Body)
+	report.End = time.Now()
+	if n := len(report.Markers); n > 0 {
+		report.Bytes = report.Markers[n-1].Bytes
+	}
+	if report.Err == nil && report.Bytes != int64(size) {
+		report.Err = fmt.Errorf("%w: copied %d bytes, expecting %d", ErrLengthMismatch, report.Bytes, size)
+	}
+	return
+}
+
+// readPerfMarkers parses the body of the response to a COPY request. It returns
+// the performance markers and an error if the copy did not succeed.
+func readPerfMarkers(r io.Reader) ([]PerfMarker, error) {
+	var markers []PerfMarker
+	var marker PerfMarker
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "Perf Marker":
+			marker = PerfMarker{}
+		case line == "End":
+			markers = append(markers, marker)
+		case strings.HasPrefix(line, "Timestamp:"):
+			ts, _ := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "Timestamp:")), 10, 64)
+			marker.Timestamp = time.Unix(ts, 0)
+		case strings.HasPrefix(line, "Stripe Bytes Transferred:"):
+			marker.Bytes, _ = strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "Stripe Bytes Transferred:")), 10, 64)
+		case strings.HasPrefix(line, "success:"):
+			return markers, nil
+		case strings.HasPrefix(line, "failure:"):
+			return markers, fmt.Errorf("third-party copy failed: %s", strings.TrimSpace(strings.TrimPrefix(line, "failure:")))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return markers, err
+	}
+	return markers, fmt.Errorf("third-party copy ended without reporting its result")
+}
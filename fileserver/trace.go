@@ -0,0 +1,128 @@
+package fileserver
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// phaseTrace records the duration of the phases of a request, as reported by
+// the hooks of net/http/httptrace. The hooks may be called concurrently, for
+// instance by a dial which completes after the request was cancelled.
+type phaseTrace struct {
+	mu sync.Mutex
+
+	dnsStart, connectStart, tlsStart, wroteRequest time.Time
+
+	dnsTime, connectTime, tlsTime, firstByteTime time.Duration
+
+	// Number of TLS handshakes completed, of those which resumed a previous
+	// session and time spent in the latter
+	tlsHandshakes, tlsResumed int
+	tlsResumedTime            time.Duration
+
+	// Whether the connection used for the request was reused and its remote
+	// address
+	reused     bool
+	remoteAddr string
+
+	// Time spent establishing the tunnel through the forward proxy of the
+	// request with a CONNECT request, if any
+	proxyConnectStart time.Time
+	proxyConnectTime  time.Duration
+}
+
+// clientTrace returns the hooks which record the phases of a request in t
+func (t *phaseTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsTime += time.Since(t.dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connectTime += time.Since(t.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			elapsed := time.Since(t.tlsStart)
+			t.tlsTime += elapsed
+			if err != nil {
+				return
+			}
+			t.tlsHandshakes++
+			if state.DidResume {
+				t.tlsResumed++
+				t.tlsResumedTime += elapsed
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.reused = info.Reused
+			if info.Conn != nil {
+				t.remoteAddr = info.Conn.RemoteAddr().String()
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.wroteRequest = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if !t.wroteRequest.IsZero() {
+				t.firstByteTime += time.Since(t.wroteRequest)
+			}
+		},
+	}
+}
+
+// record adds the phases of a request to the report. The connection and the
+// protocol are those of the response, if any.
+func (t *phaseTrace) record(report *DownloadReport, resp *http.Response) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	report.DNSTime += t.dnsTime
+	report.ConnectTime += t.connectTime
+	report.TLSHandshakeTime += t.tlsTime
+	report.TLSHandshakes += t.tlsHandshakes
+	report.TLSResumedHandshakes += t.tlsResumed
+	report.TLSResumedHandshakeTime += t.tlsResumedTime
+	report.FirstResponseByteTime += t.firstByteTime
+	report.ProxyConnectTime += t.proxyConnectTime
+	report.ConnReused = t.reused
+	if host, _, err := net.SplitHostPort(t.remoteAddr); err == nil {
+		report.RemoteIP = host
+	}
+	if resp == nil {
+		return
+	}
+	report.Protocol = resp.Proto
+	if resp.TLS != nil {
+		report.TLSVersion = tls.VersionName(resp.TLS.Version)
+		report.TLSCipherSuite = tls.CipherSuiteName(resp.TLS.CipherSuite)
+	}
+}
@@ -0,0 +1,103 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Seed of the generator of deterministicBuffer. Servers and clients must agree
+// on it, so that clients can verify the contents they receive
+const deterministicSeed = 0x63686173717569
+
+// deterministicBuffer holds the contents of the files the client requested to
+// be deterministic. They look random but are the same on every server, so that
+// the client can verify each byte it receives.
+var deterministicBuffer = makeDeterministicBuffer(int(bufferSize))
+
+// makeDeterministicBuffer returns a buffer of the given size, which must be a
+// multiple of 8, filled with the output of a splitmix64 generator seeded with
+// deterministicSeed
+func makeDeterministicBuffer(size int) []byte {
+	b := make([]byte, size)
+	state := uint64(deterministicSeed)
+	for i := 0; i < size; i += 8 {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		binary.LittleEndian.PutUint64(b[i:], z^(z>>31))
+	}
+	return b
+}
+
+// verifier compares the file contents written to it with the expected ones,
+// starting at the given offset of the file, and records the ranges of bytes
+// which differ. It keeps track of the offset across the attempts of a download.
+type verifier struct {
+	expected []byte
+	offset   int64
+
+	// Offset of the first byte which differs from the expected one or -1,
+	// number of ranges of consecutive differing bytes and total number of
+	// differing bytes
+	firstMismatch   int64
+	corruptedRanges int
+	corruptedBytes  int64
+
+	// Whether the last byte verified differs from the expected one
+	inRange bool
+}
+
+// newVerifier returns a verifier of the deterministic file contents received
+// from offset on
+func newVerifier(offset int64) *verifier {
+	return &verifier{expected: deterministicBuffer, offset: offset, firstMismatch: -1}
+}
+
+func (v *verifier) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		pos := int(v.offset % int64(len(v.expected)))
+		chunk := p
+		if len(chunk) > len(v.expected)-pos {
+			chunk = chunk[:len(v.expected)-pos]
+		}
+		if bytes.Equal(chunk, v.expected[pos:pos+len(chunk)]) {
+			v.inRange = false
+		} else {
+			for i, b := range chunk {
+				v.check(b == v.expected[pos+i], v.offset+int64(i))
+			}
+		}
+		v.offset += int64(len(chunk))
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// check records whether the byte at the given offset matches the expected one
+func (v *verifier) check(match bool, offset int64) {
+	if match {
+		v.inRange = false
+		return
+	}
+	if v.firstMismatch < 0 {
+		v.firstMismatch = offset
+	}
+	if !v.inRange {
+		v.corruptedRanges++
+		v.inRange = true
+	}
+	v.corruptedBytes++
+}
+
+// record adds the mismatches found by the verifier to the report
+func (v *verifier) record(report *DownloadReport) {
+	if v == nil {
+		return
+	}
+	report.Verified = true
+	report.FirstMismatch = v.firstMismatch
+	report.CorruptedRanges = v.corruptedRanges
+	report.CorruptedBytes = v.corruptedBytes
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/airnandez/chasqui/fileserver"
+)
+
+func init() {
+	RegisterBackend("fileserver", fsVerifyLoadRequest, newFsBackend)
+}
+
+// baseBackend holds the state shared by all the transferers of a load
+// request, whatever the protocol
+type baseBackend struct {
+	config clientConfig
+	req    *LoadRequest
+
+	// Limiter of the receive rate of the whole process, if any
+	processLimiter *fileserver.RateLimiter
+
+	// Cache of the TLS sessions shared by the transferers, if they resume
+	// sessions
+	sessionCache tls.ClientSessionCache
+}
+
+// fsBackend transfers files with chasqui file servers
+type fsBackend struct {
+	baseBackend
+
+	digestFields fileserver.DigestFields
+}
+
+// fsVerifyLoadRequest checks the fields of the load request specific to the
+// file servers
+func fsVerifyLoadRequest(req *LoadRequest) error {
+	_, err := clientDigestFields(req)
+	return err
+}
+
+func newFsBackend(config clientConfig, req *LoadRequest) (Backend, error) {
+	b := &fsBackend{baseBackend: newBaseBackend(config, req)}
+	b.digestFields, _ = clientDigestFields(req)
+	return b, nil
+}
+
+// newBaseBackend returns the state shared by all the transferers of the load
+// request
+func newBaseBackend(config clientConfig, req *LoadRequest) baseBackend {
+	b := baseBackend{config: config, req: req}
+	if req.ProcessRate > 0 {
+		b.processLimiter = fileserver.NewRateLimiter(req.ProcessRate)
+	}
+	if req.SessionResumption {
+		// Sessions are not kept across load requests, so that the first
+		// handshake with each server is a full one
+		b.sessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return b
+}
+
+// newClient returns a fileserver client, with its own transport, configured
+// with the connection, retry and rate settings of the load request
+func (b *baseBackend) newClient() (*fileserver.Client, error) {
+	config, req := b.config, b.req
+	c, err := fileserver.NewClient(req.UseHttp1, config.cert, config.key, config.ca)
+	if err != nil {
+		return nil, err
+	}
+	c.Retry.MaxAttempts = req.MaxAttempts
+	c.SampleInterval = req.SampleInterval
+	c.DialTimeout = req.DialTimeout
+	c.TLSHandshakeTimeout = req.TLSHandshakeTimeout
+	c.FirstByteTimeout = req.FirstByteTimeout
+	c.StallTimeout = req.StallTimeout
+	c.RateLimiter = b.processLimiter
+	c.SetSessionCache(b.sessionCache)
+	if len(req.Proxy) > 0 {
+		c.Proxy, _ = fileserver.ParseProxyURL(req.Proxy)
+	}
+	if req.ConnsPerServer > 0 {
+		c.LimitConnections(1)
+	}
+	if req.Churn {
+		c.DisableKeepAlives()
+	}
+	return c, nil
+}
+
+// verifyDownloadOnly checks the load request only requires downloads and
+// checksums computed by the clients
+func verifyDownloadOnly(req *LoadRequest) error {
+	if mode, _ := clientCopyMode(req); mode != fileserver.CopyNone {
+		return fmt.Errorf("transfer mode %q is not supported by backend %q", req.TransferMode, req.Backend)
+	}
+	if mode, _, _ := clientChecksumParams(req); mode == fileserver.ChecksumServerOnly || mode == fileserver.ChecksumClientAndServer {
+		return fmt.Errorf("backend %q only supports checksums computed by the clients", req.Backend)
+	}
+	return nil
+}
+
+// NewTransferer returns a transferer which uses its own fileserver client,
+// and therefore its own transport, against the server
+func (b *fsBackend) NewTransferer(server string) (Transferer, error) {
+	c, err := b.newClient()
+	if err != nil {
+		return nil, err
+	}
+	req := b.req
+	c.Digest = b.digestFields
+	c.Compressible = req.Compressible
+	c.Verify = req.Verify
+	c.AcceptEncoding = req.AcceptEncoding
+	c.UpfrontLength = req.UpfrontLength
+	if len(b.config.token) > 0 {
+		// Read the token for each load request, as it may have been renewed
+		if err := c.LoadToken(b.config.token); err != nil {
+			return nil, err
+		}
+	}
+	return &fsTransferer{Client: c}, nil
+}
+
+// fsTransferer transfers files with a chasqui file server
+type fsTransferer struct {
+	*fileserver.Client
+}
+
+// Transfer downloads a file from the server or requests the server to
+// perform a third-party copy, according to req
+func (t *fsTransferer) Transfer(ctx context.Context, req *DownloadReq, dst io.Writer) *DownloadResp {
+	if req.copyMode != fileserver.CopyNone {
+		report := t.CopyFileContext(ctx, req.server, req.peer, req.fileID, int(req.size), req.copyMode)
+		return &DownloadResp{
+			start:    report.Start,
+			end:      report.End,
+			err:      report.Err,
+			received: uint64(report.Bytes),
+		}
+	}
+	report := t.DownloadFileParallelContext(ctx, req.server, req.fileID, int(req.size), req.streams, req.chkMode, req.chkAlgo, dst)
+	return downloadResp(report)
+}
+
+// downloadResp returns the response to the worker for a download, whatever
+// the backend which performed it
+func downloadResp(report fileserver.DownloadReport) *DownloadResp {
+	timeouts, stalls := countTimeouts(report)
+	return &DownloadResp{
+		start: report.Start,
+		end:   report.End,
+		err:   report.Err,
+
+		wireSize:   uint64(report.WireBytes),
+		decodeTime: report.DecodeTime,
+
+		redirects:    report.Redirects,
+		redirectTime: report.RedirectTime,
+
+		tokenTime: report.TokenValidationTime,
+
+		received: uint64(report.Bytes),
+
+		retries: countRetries(report),
+		resumed: countResumed(report),
+
+		imbalance: streamImbalance(report.Streams),
+
+		dnsTime:       report.DNSTime,
+		connectTime:   report.ConnectTime,
+		tlsTime:       report.TLSHandshakeTime,
+		firstByteTime: report.FirstResponseByteTime,
+		reused:        report.ConnReused,
+		remoteIP:      report.RemoteIP,
+		protocol:      protocolName(report),
+
+		tlsHandshakes:  report.TLSHandshakes,
+		tlsResumed:     report.TLSResumedHandshakes,
+		tlsResumedTime: report.TLSResumedHandshakeTime,
+
+		proxied:          report.Proxy != "",
+		proxyConnectTime: report.ProxyConnectTime,
+
+		samples: report.Samples,
+
+		timeouts: timeouts,
+		stalls:   stalls,
+
+		throttleTime: report.ThrottleTime,
+
+		corruptedRanges: report.CorruptedRanges,
+		corruptedBytes:  report.CorruptedBytes,
+	}
+}
+
+// protocolName returns the protocol and the TLS parameters negotiated for a
+// download, e.g. "HTTP/2.0 TLS 1.3 TLS_AES_128_GCM_SHA256"
+func protocolName(report fileserver.DownloadReport) string {
+	if report.Protocol == "" {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s %s %s", report.Protocol, report.TLSVersion, report.TLSCipherSuite))
+}
+
+// streamImbalance returns the time elapsed between the end of the first and
+// of the last stream of a parallel download
+func streamImbalance(streams []fileserver.DownloadReport) time.Duration {
+	if len(streams) == 0 {
+		return 0
+	}
+	first, last := streams[0].End, streams[0].End
+	for _, s := range streams[1:] {
+		if s.End.Before(first) {
+			first = s.End
+		}
+		if s.End.After(last) {
+			last = s.End
+		}
+	}
+	return last.Sub(first)
+}
+
+// countTimeouts returns the number of attempts of a download, including those
+// of its streams, which timed out before receiving the file contents and the
+// number of those which stalled while receiving them
+func countTimeouts(report fileserver.DownloadReport) (timeouts, stalls int) {
+	for _, a := range report.Attempts {
+		switch a.Err.(type) {
+		case *fileserver.DialTimeoutError, *fileserver.TLSHandshakeTimeoutError, *fileserver.FirstByteTimeoutError:
+			timeouts++
+		case *fileserver.StallError:
+			stalls++
+		}
+	}
+	for _, s := range report.Streams {
+		t, st := countTimeouts(s)
+		timeouts, stalls = timeouts+t, stalls+st
+	}
+	return
+}
+
+// countRetries returns the number of attempts of a download, including those
+// of its streams, which retried a failed attempt, that is, all the attempts
+// of the download or of each stream but the first
+func countRetries(report fileserver.DownloadReport) int {
+	n := 0
+	if len(report.Attempts) > 1 {
+		n = len(report.Attempts) - 1
+	}
+	for _, s := range report.Streams {
+		n += countRetries(s)
+	}
+	return n
+}
+
+// countResumed returns the number of attempts of a download, including those
+// of its streams, which resumed an interrupted attempt. A resumed attempt
+// starts after the offset the first attempt of the download or of the stream
+// started at
+func countResumed(report fileserver.DownloadReport) int {
+	n := 0
+	if len(report.Attempts) > 0 {
+		first := report.Attempts[0].Offset
+		for _, a := range report.Attempts[1:] {
+			if a.Offset > first {
+				n++
+			}
+		}
+	}
+	for _, s := range report.Streams {
+		n += countResumed(s)
+	}
+	return n
+}
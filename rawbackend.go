@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/airnandez/chasqui/fileserver"
+)
+
+func init() {
+	RegisterBackend("raw", rawVerifyLoadRequest, newRawBackend(false))
+	RegisterBackend("raw-tls", rawVerifyLoadRequest, newRawBackend(true))
+}
+
+// rawBackend downloads files from chasqui file servers with the raw protocol
+type rawBackend struct {
+	baseBackend
+
+	// Whether the connections are secured with TLS
+	secure bool
+}
+
+// rawVerifyLoadRequest checks the fields of the load request specific to the
+// raw protocol, which only serves downloads of random contents with a single
+// stream and does not compute checksums
+func rawVerifyLoadRequest(req *LoadRequest) error {
+	if req.Streams > 1 {
+		return fmt.Errorf("backend %q does not support several streams per file", req.Backend)
+	}
+	if req.Verify {
+		return fmt.Errorf("backend %q does not support content verification", req.Backend)
+	}
+	return verifyDownloadOnly(req)
+}
+
+// newRawBackend returns a factory of backends which download files with the
+// raw protocol, over TLS if secure is true
+func newRawBackend(secure bool) BackendFactory {
+	return func(config clientConfig, req *LoadRequest) (Backend, error) {
+		return &rawBackend{baseBackend: newBaseBackend(config, req), secure: secure}, nil
+	}
+}
+
+// NewTransferer returns a transferer which uses its own client, and therefore
+// its own pool of raw connections, against the server
+func (b *rawBackend) NewTransferer(server string) (Transferer, error) {
+	c, err := b.newClient()
+	if err != nil {
+		return nil, err
+	}
+	return &rawTransferer{Client: c, secure: b.secure}, nil
+}
+
+// rawTransferer downloads files from a chasqui file server with the raw
+// protocol
+type rawTransferer struct {
+	*fileserver.Client
+	secure bool
+}
+
+// Transfer downloads a file from the server. Third-party copies are rejected
+// by rawVerifyLoadRequest
+func (t *rawTransferer) Transfer(ctx context.Context, req *DownloadReq, dst io.Writer) *DownloadResp {
+	report := t.DownloadFileRawContext(ctx, req.server, req.fileID, int(req.size), t.secure, req.chkMode, req.chkAlgo, dst)
+	return downloadResp(report)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/airnandez/chasqui/fileserver"
+)
+
+func init() {
+	RegisterBackend("s3", s3VerifyLoadRequest, newS3Backend)
+}
+
+// s3Backend downloads files as objects from S3-compatible servers
+type s3Backend struct {
+	baseBackend
+
+	// Bucket, key template, region and credentials of the requests
+	s3 *fileserver.S3Config
+}
+
+// s3VerifyLoadRequest checks the fields of the load request specific to S3
+// servers, which only serve downloads and do not compute checksums
+func s3VerifyLoadRequest(req *LoadRequest) error {
+	if len(req.S3Bucket) == 0 {
+		return fmt.Errorf("a bucket must be provided along with backend %q", req.Backend)
+	}
+	return verifyDownloadOnly(req)
+}
+
+// newS3Backend returns a backend which downloads files as objects from S3
+// servers, signing the requests with the credentials of the client process,
+// if any
+func newS3Backend(config clientConfig, req *LoadRequest) (Backend, error) {
+	b := &s3Backend{baseBackend: newBaseBackend(config, req)}
+	b.s3 = &fileserver.S3Config{
+		Bucket:      req.S3Bucket,
+		KeyTemplate: req.S3KeyTemplate,
+		Region:      req.S3Region,
+	}
+	if len(config.s3Credentials) > 0 {
+		// Read the credentials for each load request, as they may have been renewed
+		creds, err := fileserver.LoadS3Credentials(config.s3Credentials)
+		if err != nil {
+			return nil, err
+		}
+		b.s3.Credentials = creds
+	}
+	return b, nil
+}
+
+// NewTransferer returns a transferer which uses its own client, and therefore
+// its own transport, against the server
+func (b *s3Backend) NewTransferer(server string) (Transferer, error) {
+	c, err := b.newClient()
+	if err != nil {
+		return nil, err
+	}
+	c.Verify = b.req.Verify
+	return &s3Transferer{Client: c, s3: b.s3}, nil
+}
+
+// s3Transferer downloads files as objects from a S3-compatible server
+type s3Transferer struct {
+	*fileserver.Client
+	s3 *fileserver.S3Config
+}
+
+// Transfer downloads the object holding a file from the server. Third-party
+// copies are rejected by s3VerifyLoadRequest
+func (t *s3Transferer) Transfer(ctx context.Context, req *DownloadReq, dst io.Writer) *DownloadResp {
+	report := t.DownloadObjectContext(ctx, t.s3, req.server, req.fileID, int(req.size), req.streams, req.chkMode, req.chkAlgo, dst)
+	return downloadResp(report)
+}
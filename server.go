@@ -2,12 +2,18 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"strings"
 
 	"github.com/airnandez/chasqui/fileserver"
 )
 
+const (
+	defaultRedirectStrategy = "roundrobin"
+	defaultRedirectStatus   = 302
+)
+
 type serverConfig struct {
 	// Command line options
 	help bool
@@ -15,6 +21,31 @@ type serverConfig struct {
 	ca   string
 	cert string
 	key  string
+
+	// Redirector mode
+	redirectTo       string
+	redirectStrategy string
+	redirectStatus   int
+
+	// Third-party copy
+	tpc bool
+
+	// Bearer token authentication
+	tokenKeys     string
+	tokenIssuer   string
+	tokenAudience string
+
+	// S3-style objects
+	s3            bool
+	s3Credentials string
+
+	// Raw protocol listeners
+	rawAddr    string
+	rawTLSAddr string
+
+	// TLS session resumption
+	sessionTickets bool
+	ticketKeys     string
 }
 
 func serverCmd() command {
@@ -26,6 +57,19 @@ func serverCmd() command {
 	fset.StringVar(&config.ca, "ca", "ca.pem", "")
 	fset.StringVar(&config.cert, "cert", "cert.pem", "")
 	fset.StringVar(&config.key, "key", "key.pem", "")
+	fset.StringVar(&config.redirectTo, "redirect-to", "", "")
+	fset.StringVar(&config.redirectStrategy, "redirect-strategy", defaultRedirectStrategy, "")
+	fset.IntVar(&config.redirectStatus, "redirect-status", defaultRedirectStatus, "")
+	fset.BoolVar(&config.tpc, "tpc", false, "")
+	fset.StringVar(&config.tokenKeys, "token-keys", "", "")
+	fset.StringVar(&config.tokenIssuer, "token-issuer", "", "")
+	fset.StringVar(&config.tokenAudience, "token-audience", "", "")
+	fset.BoolVar(&config.s3, "s3", false, "")
+	fset.StringVar(&config.s3Credentials, "s3-credentials", "", "")
+	fset.StringVar(&config.rawAddr, "raw-addr", "", "")
+	fset.StringVar(&config.rawTLSAddr, "raw-tls-addr", "", "")
+	fset.BoolVar(&config.sessionTickets, "session-tickets", true, "")
+	fset.StringVar(&config.ticketKeys, "ticket-keys", "", "")
 	run := func(args []string) error {
 		fset.Usage = func() { serverUsage(args[0], os.Stderr) }
 		fset.Parse(args[1:])
@@ -44,12 +88,78 @@ func serverRun(cmdName string, config serverConfig) error {
 	debug(1, "   cert='%s'\n", config.cert)
 	debug(1, "   key='%s'\n", config.key)
 	debug(1, "   addr='%s'\n", config.addr)
+	debug(1, "   redirect-to='%s'\n", config.redirectTo)
+	debug(1, "   redirect-strategy='%s'\n", config.redirectStrategy)
+	debug(1, "   redirect-status=%d\n", config.redirectStatus)
+	debug(1, "   tpc=%t\n", config.tpc)
+	debug(1, "   token-keys='%s'\n", config.tokenKeys)
+	debug(1, "   token-issuer='%s'\n", config.tokenIssuer)
+	debug(1, "   token-audience='%s'\n", config.tokenAudience)
+	debug(1, "   s3=%t\n", config.s3)
+	debug(1, "   s3-credentials='%s'\n", config.s3Credentials)
+	debug(1, "   raw-addr='%s'\n", config.rawAddr)
+	debug(1, "   raw-tls-addr='%s'\n", config.rawTLSAddr)
+	debug(1, "   session-tickets=%t\n", config.sessionTickets)
+	debug(1, "   ticket-keys='%s'\n", config.ticketKeys)
 
+	if !config.sessionTickets && len(config.ticketKeys) > 0 {
+		return fmt.Errorf("session ticket keys cannot be specified along with disabled session tickets")
+	}
 	fs, err := fileserver.NewServer(config.addr, config.cert, config.key, config.ca)
 	if err != nil {
 		return err
 	}
-	return fs.Serve()
+	if !config.sessionTickets {
+		fs.DisableSessionTickets()
+	} else if len(config.ticketKeys) > 0 {
+		keys, err := fileserver.LoadSessionTicketKeys(config.ticketKeys)
+		if err != nil {
+			return err
+		}
+		fs.SetSessionTicketKeys(keys)
+	}
+	if len(config.redirectTo) > 0 {
+		strategy, err := fileserver.RedirectStrategyByName(config.redirectStrategy)
+		if err != nil {
+			return err
+		}
+		if err := fs.RedirectTo(splitAndClean(config.redirectTo), strategy, config.redirectStatus); err != nil {
+			return err
+		}
+	}
+	if config.tpc {
+		// Files are transferred with other servers anonymously
+		c, err := fileserver.NewClient(false, "", "", config.ca)
+		if err != nil {
+			return err
+		}
+		fs.EnableThirdPartyCopy(c, fileserver.DefaultMarkerInterval)
+	}
+	if len(config.tokenKeys) > 0 {
+		if err := fs.EnableTokens(config.tokenKeys, config.tokenIssuer, config.tokenAudience); err != nil {
+			return err
+		}
+	}
+	if config.s3 {
+		var creds fileserver.S3Credentials
+		if len(config.s3Credentials) > 0 {
+			if creds, err = fileserver.LoadS3Credentials(config.s3Credentials); err != nil {
+				return err
+			}
+		}
+		fs.EnableS3(creds)
+	}
+
+	// Serve the raw protocol alongside HTTP until one of the listeners fails
+	errs := make(chan error, 3)
+	if len(config.rawAddr) > 0 {
+		go func() { errs <- fs.ServeRaw(config.rawAddr, false) }()
+	}
+	if len(config.rawTLSAddr) > 0 {
+		go func() { errs <- fs.ServeRaw(config.rawTLSAddr, true) }()
+	}
+	go func() { errs <- fs.Serve() }()
+	return <-errs
 }
 
 //  masterUsage prints the usage information about the 'master' subcommand
@@ -57,7 +167,12 @@ func serverUsage(cmd string, f *os.File) {
 	const serverTempl = `
 USAGE:
 {{.Tab1}}{{.AppName}} {{.SubCmd}} [-addr=<network address>] [-ca=<file>] [-cert=<file>]
-{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-key=<file>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-key=<file>] [-redirect-to=<network addresses>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-redirect-strategy=<strategy>] [-redirect-status=<code>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-tpc] [-token-keys=<file>] [-token-issuer=<issuer>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-token-audience=<audience>] [-s3] [-s3-credentials=<file>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-raw-addr=<network address>] [-raw-tls-addr=<network address>]
+{{.Tab1}}{{.AppNameFiller}} {{.SubCmdFiller}} [-session-tickets=<bool>] [-ticket-keys=<file>]
 {{.Tab1}}{{.AppName}} {{.SubCmd}} -help
 
 DESCRIPTION:
@@ -91,11 +206,101 @@ OPTIONS:
 {{.Tab2}}the certificate specified with the '-cert' option.
 {{.Tab2}}Default: key.pem
 
+{{.Tab1}}-redirect-to=<network addresses>
+{{.Tab2}}list of comma-separated network addresses of file servers this
+{{.Tab2}}server redirects file download requests to, instead of serving them.
+{{.Tab2}}The form of each address is 'host:port'. This allows for emulating
+{{.Tab2}}the redirectors of storage federations.
+{{.Tab2}}Default: this server serves the file download requests.
+
+{{.Tab1}}-redirect-strategy=<strategy>
+{{.Tab2}}specifies how the server selects the file server each request is
+{{.Tab2}}redirected to. Accepted values are 'roundrobin', 'hash' for selecting
+{{.Tab2}}the server according to a hash of the file identifier and 'random'.
+{{.Tab2}}Default: {{.DefaultRedirectStrategy}}
+
+{{.Tab1}}-redirect-status=<code>
+{{.Tab2}}specifies the HTTP status code of the redirection responses. Accepted
+{{.Tab2}}values are 302 and 307.
+{{.Tab2}}Default: {{.DefaultRedirectStatus}}
+
+{{.Tab1}}-tpc
+{{.Tab2}}enables this server to accept third-party copy requests, as specified
+{{.Tab2}}by the WLCG HTTP-TPC protocol. On reception of a COPY request with a
+{{.Tab2}}'Source' header this server pulls the file from the server in that
+{{.Tab2}}URL and, with a 'Destination' header, it pushes the file to that
+{{.Tab2}}server. This server identifies itself anonymously to the other server
+{{.Tab2}}and verifies its certificate against the certification authorities
+{{.Tab2}}in the file specified with the '-ca' option.
+
+{{.Tab1}}-token-keys=<file>
+{{.Tab2}}path of the JSON web key set (JWKS) file which contains the public
+{{.Tab2}}keys of the issuer of bearer tokens. If specified, clients may
+{{.Tab2}}authenticate by presenting a JWT token, such as a WLCG token, in the
+{{.Tab2}}'Authorization' header of their requests instead of a certificate.
+{{.Tab2}}The 'storage.read:/path' scopes of the token grant read access to
+{{.Tab2}}the files whose identifiers are under '/path' and the
+{{.Tab2}}'storage.create:/path' and 'storage.modify:/path' scopes grant write
+{{.Tab2}}access to them. RSA and EC keys are supported.
+{{.Tab2}}Default: bearer tokens are rejected.
+
+{{.Tab1}}-token-issuer=<issuer>
+{{.Tab2}}if specified, the bearer tokens must have been issued by this
+{{.Tab2}}issuer, as stated in their 'iss' claim.
+
+{{.Tab1}}-token-audience=<audience>
+{{.Tab2}}if specified, the bearer tokens must be intended for this audience
+{{.Tab2}}or for any WLCG service, as stated in their 'aud' claim.
+
+{{.Tab1}}-s3
+{{.Tab2}}enables this server to serve synthetic objects at '/<bucket>/<key>'
+{{.Tab2}}paths with S3-style responses, in addition to the files at the
+{{.Tab2}}'/file' path. Any bucket holds any object whose key ends with
+{{.Tab2}}'-<size>', where size is the size of the object in bytes. The
+{{.Tab2}}contents of the objects are deterministic, so that clients can
+{{.Tab2}}verify them.
+
+{{.Tab1}}-s3-credentials=<file>
+{{.Tab2}}path of the file which contains the access key identifier and the
+{{.Tab2}}secret access key, separated by white space, the requests for S3
+{{.Tab2}}objects must be signed with, using AWS Signature Version 4.
+{{.Tab2}}Default: the requests for S3 objects are not authenticated.
+
+{{.Tab1}}-raw-addr=<network address>
+{{.Tab2}}network address this server listens to for requests of the raw
+{{.Tab2}}protocol over TCP, in addition to the HTTP requests. The raw protocol
+{{.Tab2}}is a minimal length-prefixed protocol without HTTP, which serves as a
+{{.Tab2}}baseline for measuring the overhead of HTTP. Raw requests are not
+{{.Tab2}}authorized.
+{{.Tab2}}Default: the raw protocol over TCP is disabled.
+
+{{.Tab1}}-raw-tls-addr=<network address>
+{{.Tab2}}network address this server listens to for requests of the raw
+{{.Tab2}}protocol over TLS, using the certificate specified with '-cert'.
+{{.Tab2}}Default: the raw protocol over TLS is disabled.
+
+{{.Tab1}}-session-tickets=<bool>
+{{.Tab2}}whether this server issues TLS session tickets, which allow the
+{{.Tab2}}clients to resume their sessions with an abbreviated handshake when
+{{.Tab2}}they establish new connections. Set it to false for requiring a full
+{{.Tab2}}handshake for each new connection.
+{{.Tab2}}Default: true
+
+{{.Tab1}}-ticket-keys=<file>
+{{.Tab2}}path of the file which contains the keys used for encrypting and
+{{.Tab2}}decrypting the session tickets, one hex-encoded 32-byte key per line.
+{{.Tab2}}The first key encrypts new tickets. Servers sharing the same keys can
+{{.Tab2}}resume the sessions the clients established with each other.
+{{.Tab2}}Default: the keys are generated by this server and rotated
+{{.Tab2}}periodically.
+
 {{.Tab1}}-help
 {{.Tab2}}print this help
 `
 	tmplFields["SubCmd"] = cmd
 	tmplFields["SubCmdFiller"] = strings.Repeat(" ", len(cmd))
 	tmplFields["DefaultServerAddr"] = defaultServerAddr
+	tmplFields["DefaultRedirectStrategy"] = defaultRedirectStrategy
+	tmplFields["DefaultRedirectStatus"] = fmt.Sprintf("%d", defaultRedirectStatus)
 	render(serverTempl, tmplFields, f)
 }
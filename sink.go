@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// sinkMode specifies where the clients write the contents of the downloaded files
+type sinkMode int
+
+const (
+	// Discard the downloaded data
+	sinkDiscard sinkMode = iota
+
+	// Write to files in a directory via the page cache
+	sinkBuffered
+
+	// Same as sinkBuffered but flush each file to storage before closing it
+	sinkFsync
+
+	// Write to files in a directory bypassing the page cache (O_DIRECT)
+	sinkDirect
+
+	// Write to files in a tmpfs directory, i.e. to memory
+	sinkTmpfs
+)
+
+const (
+	// Default directory of the tmpfs sink
+	defaultTmpfsDir = "/dev/shm"
+
+	// Alignment of the buffers, offsets and lengths of O_DIRECT writes and
+	// size of the buffer of the data written with O_DIRECT
+	directAlignment  = 4096
+	directBufferSize = 1024 * 1024
+)
+
+// clientSinkMode returns the sink mode specified in the load request
+func clientSinkMode(req *LoadRequest) (sinkMode, error) {
+	switch strings.ToLower(req.Sink) {
+	case "discard", "":
+		return sinkDiscard, nil
+	case "buffered":
+		return sinkBuffered, nil
+	case "fsync":
+		return sinkFsync, nil
+	case "direct":
+		return sinkDirect, nil
+	case "tmpfs":
+		return sinkTmpfs, nil
+	}
+	return sinkDiscard, fmt.Errorf("invalid sink mode %q", req.Sink)
+}
+
+// clientSinkDir returns the directory where the downloaded files are written
+// according to the load request or the empty string if they are discarded
+func clientSinkDir(req *LoadRequest) (string, error) {
+	mode, err := clientSinkMode(req)
+	if err != nil || mode == sinkDiscard {
+		return "", err
+	}
+	dir := req.SinkDir
+	if len(dir) == 0 {
+		if mode != sinkTmpfs {
+			return "", fmt.Errorf("a sink directory must be provided along with sink mode %q", req.Sink)
+		}
+		dir = defaultTmpfsDir
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("invalid sink directory: %s", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("invalid sink directory: %s is not a directory", dir)
+	}
+	return dir, nil
+}
+
+// sink is the destination of the contents of a downloaded file. It accounts
+// for the time spent writing them
+type sink interface {
+	io.Writer
+
+	// close flushes the written data according to the sink mode, closes the
+	// sink and removes the file written, if any
+	close() error
+
+	// writeTime returns the time spent writing, flushing and closing the
+	// sink. Concurrent writes are accounted for once, so that the write time
+	// does not exceed the duration of the download
+	writeTime() time.Duration
+}
+
+// openSink opens the sink where the contents of the given file are written
+// according to mode, which must not be sinkDiscard. The sinks of all the modes
+// but sinkDirect implement io.WriterAt, so that parallel downloads write each
+// range at its offset. The sink of mode sinkDirect writes sequentially, so
+// parallel downloads buffer in memory the ranges received out of order until
+// the preceding ones are complete, which may amount to most of the file.
+func openSink(mode sinkMode, dir, fileID string) (sink, error) {
+	// Several client processes may write to the same directory
+	name := filepath.Join(dir, fmt.Sprintf("chasqui-%d-%s", os.Getpid(), fileID))
+	if mode == sinkDirect {
+		start := time.Now()
+		f, err := openDirect(name)
+		if err != nil {
+			return nil, fmt.Errorf("error opening sink file: %s", err)
+		}
+		return &directSink{
+			f:       f,
+			buf:     alignedBuffer(directBufferSize, directAlignment),
+			elapsed: time.Since(start),
+		}, nil
+	}
+	start := time.Now()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening sink file: %s", err)
+	}
+	return &fileSink{f: f, sync: mode == sinkFsync, elapsed: time.Since(start)}, nil
+}
+
+// fileSink writes to a file via the page cache. Its WriteAt method may be
+// called concurrently
+type fileSink struct {
+	f      *os.File
+	offset int64
+	sync   bool
+
+	// Time elapsed while at least one write was in progress, number of writes
+	// in progress and time the first of them started
+	mu      sync.Mutex
+	elapsed time.Duration
+	active  int
+	busy    time.Time
+}
+
+func (s *fileSink) Write(p []byte) (int, error) {
+	n, err := s.WriteAt(p, s.offset)
+	s.offset += int64(n)
+	return n, err
+}
+
+func (s *fileSink) WriteAt(p []byte, off int64) (int, error) {
+	s.begin()
+	defer s.end()
+	return s.f.WriteAt(p, off)
+}
+
+// begin and end delimit an operation on the file, for accounting for the
+// time elapsed while operations are in progress
+func (s *fileSink) begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == 0 {
+		s.busy = time.Now()
+	}
+	s.active++
+}
+
+func (s *fileSink) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if s.active == 0 {
+		s.elapsed += time.Since(s.busy)
+	}
+}
+
+func (s *fileSink) close() error {
+	s.begin()
+	defer func() {
+		s.end()
+		os.Remove(s.f.Name())
+	}()
+	if s.sync {
+		if err := s.f.Sync(); err != nil {
+			s.f.Close()
+			return fmt.Errorf("error flushing sink file: %s", err)
+		}
+	}
+	return s.f.Close()
+}
+
+func (s *fileSink) writeTime() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.elapsed
+}
+
+// directSink writes sequentially to a file opened with O_DIRECT. It buffers
+// the written data, so that it writes aligned blocks.
+type directSink struct {
+	f       *os.File
+	buf     []byte
+	n       int
+	offset  int64
+	elapsed time.Duration
+}
+
+func (s *directSink) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		c := copy(s.buf[s.n:], p)
+		s.n += c
+		written += c
+		p = p[c:]
+		if s.n == len(s.buf) {
+			if err := s.flush(s.n); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush writes the first n bytes of the buffer, which must be a multiple of
+// the alignment, and moves the remaining ones to its start
+func (s *directSink) flush(n int) error {
+	start := time.Now()
+	defer func() {
+		s.elapsed += time.Since(start)
+	}()
+	if _, err := s.f.WriteAt(s.buf[:n], s.offset); err != nil {
+		return err
+	}
+	s.offset += int64(n)
+	s.n = copy(s.buf, s.buf[n:s.n])
+	return nil
+}
+
+func (s *directSink) close() error {
+	defer os.Remove(s.f.Name())
+
+	// Write the aligned part of the buffered data, then the remaining bytes
+	// without O_DIRECT, which requires aligned lengths
+	if err := s.flush(s.n - s.n%directAlignment); err != nil {
+		s.f.Close()
+		return fmt.Errorf("error writing sink file: %s", err)
+	}
+	start := time.Now()
+	defer func() {
+		s.elapsed += time.Since(start)
+	}()
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	if s.n == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(s.f.Name(), os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing sink file: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(s.buf[:s.n], s.offset); err != nil {
+		return fmt.Errorf("error writing sink file: %s", err)
+	}
+	return f.Sync()
+}
+
+func (s *directSink) writeTime() time.Duration {
+	return s.elapsed
+}
+
+// alignedBuffer returns a buffer of the given size whose address is a
+// multiple of align
+func alignedBuffer(size, align int) []byte {
+	buf := make([]byte, size+align)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(align)); rem != 0 {
+		shift = align - rem
+	}
+	return buf[shift : shift+size]
+}
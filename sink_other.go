@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// openDirect creates the named file for writing to it bypassing the page cache
+func openDirect(name string) (*os.File, error) {
+	return nil, fmt.Errorf("writing with O_DIRECT is not supported on %s", runtime.GOOS)
+}
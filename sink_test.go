@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSinkModes(t *testing.T) {
+	// An odd size, so that the last block written with O_DIRECT is not aligned
+	size := 3*directBufferSize + 2*directAlignment + 123
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, mode := range []sinkMode{sinkBuffered, sinkFsync, sinkDirect, sinkTmpfs} {
+		dir, err := ioutil.TempDir("", "chasqui")
+		if err != nil {
+			t.Fatalf("failed creating temporary directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+		fileID := fmt.Sprintf("sink-%d", mode)
+		s, err := openSink(mode, dir, fileID)
+		if err != nil {
+			if mode == sinkDirect {
+				t.Logf("skipping sink mode direct: %s", err)
+				continue
+			}
+			t.Fatalf("[mode %d] error opening sink: %s", mode, err)
+		}
+
+		// The sink removes the file when closed, so read it via another handle
+		name := filepath.Join(dir, fmt.Sprintf("chasqui-%d-%s", os.Getpid(), fileID))
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatalf("[mode %d] error opening sink file: %s", mode, err)
+		}
+		defer f.Close()
+
+		// Write in chunks of uneven sizes
+		for p, chunk := data, 1; len(p) > 0; chunk = chunk*3 + 1 {
+			n := minInt(chunk, len(p))
+			if _, err := s.Write(p[:n]); err != nil {
+				t.Fatalf("[mode %d] error writing to sink: %s", mode, err)
+			}
+			p = p[n:]
+		}
+		if err := s.close(); err != nil {
+			t.Fatalf("[mode %d] error closing sink: %s", mode, err)
+		}
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("[mode %d] expecting sink file to be removed", mode)
+		}
+		written, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("[mode %d] error reading sink file: %s", mode, err)
+		}
+		if len(written) != size || !bytes.Equal(written, data) {
+			t.Fatalf("[mode %d] expecting %d bytes written got %d bytes, equal=%t", mode, size, len(written), bytes.Equal(written, data))
+		}
+		if s.writeTime() <= 0 {
+			t.Fatalf("[mode %d] expecting non-zero write time", mode)
+		}
+	}
+}
+
+func TestSinkConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chasqui")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Now()
+	s, err := openSink(sinkBuffered, dir, "concurrent")
+	if err != nil {
+		t.Fatalf("error opening sink: %s", err)
+	}
+
+	// Concurrent writes, as performed by parallel downloads, are accounted
+	// for once in the write time, which includes opening the file
+	w := s.(io.WriterAt)
+	const streams, chunk = 8, 1024 * 1024
+	buf := make([]byte, chunk)
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for k := 0; k < 4; k++ {
+				if _, err := w.WriteAt(buf, int64((i*4+k)*chunk)); err != nil {
+					t.Errorf("error writing to sink: %s", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if wt := s.writeTime(); wt <= 0 || wt > elapsed {
+		t.Fatalf("expecting write time within (0, %s] got %s", elapsed, wt)
+	}
+	if err := s.close(); err != nil {
+		t.Fatalf("error closing sink: %s", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Transferer performs the file transfers requested to the workers of a client
+// process against a given server. A transferer may be shared by several
+// workers, so its methods may be called concurrently.
+type Transferer interface {
+	// Transfer performs the operation specified in req, writing the
+	// downloaded file contents, if any, to dst. The operation must be
+	// aborted when ctx is done. The worker fills in the sequence number, the
+	// size and the interruption status of the returned response.
+	Transfer(ctx context.Context, req *DownloadReq, dst io.Writer) *DownloadResp
+
+	// CloseIdleConnections closes the connections to the server which are
+	// not in use
+	CloseIdleConnections()
+}
+
+// Backend creates the transferers used by a client process for serving a load
+// request. The transferers it creates may share state, such as a rate limiter.
+type Backend interface {
+	// NewTransferer returns a transferer against the given server
+	NewTransferer(server string) (Transferer, error)
+}
+
+// BackendFactory prepares a backend for serving the given load request
+type BackendFactory func(config clientConfig, req *LoadRequest) (Backend, error)
+
+// backendEntry is a backend registered with RegisterBackend
+type backendEntry struct {
+	verify  func(req *LoadRequest) error
+	factory BackendFactory
+}
+
+// backends holds the registered backends by name
+var backends = map[string]backendEntry{}
+
+// RegisterBackend makes a backend available under the given name, which the
+// load requests select via their Backend field. verify, if not nil, checks the
+// fields of a load request specific to the backend. It panics if a backend is
+// already registered with the same name, so it is meant to be called from the
+// init function of the file implementing the backend.
+func RegisterBackend(name string, verify func(req *LoadRequest) error, factory BackendFactory) {
+	name = strings.ToLower(name)
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("backend %q registered twice", name))
+	}
+	backends[name] = backendEntry{verify: verify, factory: factory}
+}
+
+// clientBackend returns the registered backend selected in the load request
+func clientBackend(req *LoadRequest) (backendEntry, error) {
+	name := strings.ToLower(req.Backend)
+	if name == "" {
+		name = defaultBackend
+	}
+	b, ok := backends[name]
+	if !ok {
+		return backendEntry{}, fmt.Errorf("invalid backend %q", req.Backend)
+	}
+	return b, nil
+}
+
+// backendNames returns the names of the registered backends, sorted
+func backendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"sync"
 	"time"
@@ -10,13 +14,22 @@ import (
 
 // DownloadReq is a HTTP download operation sent to a client worker for execution
 type DownloadReq struct {
-	seqNumber uint64
-	server    string
-	fsclient  *fileserver.Client
-	fileID    string
-	size      uint64
-	notAfter  time.Time
-	replyTo   chan<- *DownloadResp
+	seqNumber  uint64
+	server     string
+	serverIdx  int
+	transferer Transferer
+	limiter    *fileserver.RateLimiter
+	fileID     string
+	size       uint64
+	chkMode    fileserver.ChecksumMode
+	chkAlgo    fileserver.ChecksumAlgorithm
+	copyMode   fileserver.CopyMode
+	peer       string
+	streams    int
+	sinkMode   sinkMode
+	sinkDir    string
+	notAfter   time.Time
+	replyTo    chan<- *DownloadResp
 }
 
 // DownloadResp is the report sent back by a worker after performing a download operation
@@ -27,32 +40,160 @@ type DownloadResp struct {
 	end       time.Time
 	size      uint64
 	err       error
+
+	// Bytes received from the network and time spent decoding them
+	wireSize   uint64
+	decodeTime time.Duration
+
+	// Number of redirections followed and time spent following them
+	redirects    int
+	redirectTime time.Duration
+
+	// Time the server reported spending validating the bearer token
+	tokenTime time.Duration
+
+	// Whether the operation was aborted because the test ended and the
+	// number of bytes transferred until then
+	interrupted bool
+	received    uint64
+
+	// Number of attempts of the download, including those of its streams,
+	// which retried a failed attempt and of those which resumed an
+	// interrupted attempt
+	retries int
+	resumed int
+
+	// Time elapsed between the end of the first and of the last stream of
+	// the download
+	imbalance time.Duration
+
+	// Durations of the phases of the requests, whether the connection was
+	// reused, its remote IP address and the protocol and TLS parameters
+	// negotiated
+	dnsTime       time.Duration
+	connectTime   time.Duration
+	tlsTime       time.Duration
+	firstByteTime time.Duration
+	reused        bool
+	remoteIP      string
+	protocol      string
+
+	// Number of TLS handshakes, of those which resumed a session and time
+	// spent in the latter
+	tlsHandshakes  int
+	tlsResumed     int
+	tlsResumedTime time.Duration
+
+	// Whether the request was sent via a forward proxy and time spent
+	// establishing the tunnel through it, if a new one was needed
+	proxied          bool
+	proxyConnectTime time.Duration
+
+	// Cumulative number of bytes received at each sampling interval
+	samples []fileserver.ThroughputSample
+
+	// Number of attempts which timed out before receiving the file contents
+	// and of attempts which stalled while receiving them
+	timeouts int
+	stalls   int
+
+	// Time spent waiting for the receive rate limits
+	throttleTime time.Duration
+
+	// Time spent writing the downloaded data to the sink and time spent
+	// receiving it, not including the writes
+	writeTime   time.Duration
+	networkTime time.Duration
+
+	// Number of ranges of consecutive corrupted bytes received and number of
+	// corrupted bytes, if the contents were verified
+	corruptedRanges int
+	corruptedBytes  int64
 }
 
 // clientWorker is the goroutine executed by each client worker. It receives incoming
 // download requests, performs the requested operation and sends the result back
-// via the channel specified in the request
-func clientWorker(workerId int, wg *sync.WaitGroup, reqChan <-chan *DownloadReq) {
+// via the channel specified in the request. transferers holds the transferer
+// the worker uses for each server and limiter, if not nil, limits the rate at
+// which the worker receives data
+func clientWorker(workerId int, wg *sync.WaitGroup, transferers []Transferer, limiter *fileserver.RateLimiter, reqChan <-chan *DownloadReq) {
 	defer wg.Done()
 	for req := range reqChan {
 		if time.Now().After(req.notAfter) {
 			continue
 		}
+		req.transferer = transferers[req.serverIdx]
+		req.limiter = limiter
 		debug(1, "worker %d: processing download [seqNo:%d server:%s size:%d]", workerId, req.seqNumber, req.server, req.size)
 		req.replyTo <- processDownloadRequest(req)
 		debug(1, "worker %d seqNo:%d ended", workerId, req.seqNumber)
 	}
 }
 
-// processDownloadRequest perform a single file download against the server
-// specified in the argument request
+// processDownloadRequest performs a single file transfer against the server
+// specified in the argument request, using the transferer of the worker for
+// that server. The transfer is aborted if it is still in progress when the
+// test ends
 func processDownloadRequest(req *DownloadReq) *DownloadResp {
-	report := req.fsclient.DownloadFile(req.server, req.fileID, int(req.size), fileserver.ChecksumNone, fileserver.SHA256, ioutil.Discard)
-	return &DownloadResp{
-		seqNumber: req.seqNumber,
-		start:     report.Start,
-		end:       report.End,
-		size:      req.size,
-		err:       report.Err,
+	ctx, cancel := context.WithDeadline(context.Background(), req.notAfter)
+	defer cancel()
+	ctx = fileserver.ContextWithRateLimiter(ctx, req.limiter)
+	dst := io.Writer(ioutil.Discard)
+	var s sink
+	if req.copyMode == fileserver.CopyNone && req.sinkMode != sinkDiscard {
+		var err error
+		if s, err = openSink(req.sinkMode, req.sinkDir, req.fileID); err != nil {
+			now := time.Now()
+			return &DownloadResp{seqNumber: req.seqNumber, start: now, end: now, size: req.size, err: err}
+		}
+		dst = s
+	}
+	resp := req.transferer.Transfer(ctx, req, dst)
+	resp.seqNumber, resp.size = req.seqNumber, req.size
+	resp.networkTime = resp.end.Sub(resp.start)
+	if s != nil {
+		// The write time accounts for concurrent writes once, so it does not
+		// exceed the duration of the transfer
+		resp.networkTime -= s.writeTime()
+		if err := s.close(); err != nil && resp.err == nil {
+			resp.err = err
+		}
+		resp.writeTime = s.writeTime()
+	}
+	resp.interrupted = resp.err != nil && ctx.Err() != nil
+	return resp
+}
+
+// errorClass returns the class of the error of a failed download or copy,
+// used for counting errors per class
+func errorClass(err error) string {
+	var (
+		statusErr    *fileserver.HTTPStatusError
+		dialErr      *fileserver.DialTimeoutError
+		handshakeErr *fileserver.TLSHandshakeTimeoutError
+		firstByteErr *fileserver.FirstByteTimeoutError
+		stallErr     *fileserver.StallError
+		proxyErr     *fileserver.ProxyError
+	)
+	switch {
+	case errors.As(err, &statusErr):
+		return fmt.Sprintf("status %d", statusErr.Code)
+	case errors.As(err, &proxyErr):
+		return fmt.Sprintf("proxy status %d", proxyErr.Code)
+	case errors.As(err, &dialErr), errors.As(err, &handshakeErr), errors.As(err, &firstByteErr):
+		return "timeout"
+	case errors.As(err, &stallErr):
+		return "stall"
+	case errors.Is(err, fileserver.ErrChecksumMismatch):
+		return "checksum mismatch"
+	case errors.Is(err, fileserver.ErrContentMismatch):
+		return "content mismatch"
+	case errors.Is(err, fileserver.ErrLengthMismatch):
+		return "length mismatch"
+	case errors.Is(err, fileserver.ErrMissingTrailer):
+		return "missing trailer"
+	case errors.Is(err, fileserver.ErrTransport):
+		return "transport"
 	}
+	return "other"
 }